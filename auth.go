@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	jwksSource     = flag.String("jwks", "", "JWKS file or URL used to validate bearer JWTs; enables authentication")
+	jwtSecret      = flag.String("jwt-hs256-secret", "", "shared secret for HS256 bearer JWTs, may be a ${secret:name} reference; enables authentication")
+	jwtIssuer      = flag.String("jwt-issuer", "", "required iss claim of bearer JWTs")
+	jwtAudience    = flag.String("jwt-audience", "", "required aud claim of bearer JWTs")
+	jwtTenantClaim = flag.String("jwt-tenant-claim", "tenant", "claim holding the tenant of the caller; callers without one are not confined to a tenant")
+	jwksRefresh    = flag.Duration("jwks-refresh", 5*time.Minute, "how often a JWKS URL is refetched")
+)
+
+const (
+	// jwtLeeway allows for clock skew between the issuer and the server.
+	jwtLeeway = time.Minute
+	// jwksMinRefetch is the minimum time between fetches of a JWKS URL.
+	jwksMinRefetch = 10 * time.Second
+	// jwksFetchTimeout bounds a fetch of a JWKS URL, which requests with
+	// an unknown key wait for.
+	jwksFetchTimeout = 10 * time.Second
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Subject string
+	Tenant  string
+	Scopes  map[string]bool
+}
+
+type principalKey struct{}
+
+// requestPrincipal returns the caller of the request, or nil when
+// authentication is disabled.
+func requestPrincipal(r *http.Request) *Principal {
+	p, _ := r.Context().Value(principalKey{}).(*Principal)
+	return p
+}
+
+// requestTenant returns the tenant the caller is confined to, or "" if the
+// caller may use the resources of all tenants: authentication is disabled,
+// the token has no tenant claim or the caller has the admin scope.
+func requestTenant(r *http.Request) string {
+	p := requestPrincipal(r)
+	if p == nil || p.Scopes["admin"] {
+		return ""
+	}
+	return p.Tenant
+}
+
+// inTenant reports whether a named resource belongs to the tenant. Names
+// of a tenant start with the tenant and a slash, like "acme/deploy".
+func inTenant(tenant, name string) bool {
+	return tenant == "" || strings.HasPrefix(name, tenant+"/")
+}
+
+// ownedBy reports whether a resource created by owner is visible to a
+// caller confined to tenant.
+func ownedBy(tenant, owner string) bool {
+	return tenant == "" || tenant == owner
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+var (
+	jwksKeys = make(map[string]interface{})
+	// jwksAttempted is when the JWKS was last fetched or tried to be.
+	jwksAttempted time.Time
+	// jwksRefreshing is closed when the running refresh of a JWKS URL
+	// ends, and nil while none runs.
+	jwksRefreshing chan struct{}
+	jwksMu         sync.Mutex
+	jwksClient     = &http.Client{Timeout: jwksFetchTimeout}
+)
+
+func authEnabled() bool {
+	return *jwksSource != "" || *jwtSecret != ""
+}
+
+func loadJWKS() error {
+	if *jwksSource == "" {
+		return nil
+	}
+
+	var data []byte
+	var err error
+	if strings.HasPrefix(*jwksSource, "http://") || strings.HasPrefix(*jwksSource, "https://") {
+		var resp *http.Response
+		resp, err = jwksClient.Get(*jwksSource)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("fetching JWKS: %s", resp.Status)
+		}
+		data, err = io.ReadAll(resp.Body)
+	} else {
+		data, err = os.ReadFile(*jwksSource)
+	}
+	if err != nil {
+		return err
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("parsing JWKS: %v", err)
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return fmt.Errorf("JWKS key %q: %v", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+
+	jwksMu.Lock()
+	jwksKeys = keys
+	jwksAttempted = clock.Now()
+	jwksMu.Unlock()
+	return nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !key.Curve.IsOnCurve(x, y) {
+			return nil, errors.New("point not on curve")
+		}
+		return key, nil
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(k.K)
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// lookupKey finds the key for a kid, refetching a JWKS URL when it is stale
+// or the kid is unknown. Only one refetch runs at a time: callers with a
+// known key keep using it meanwhile, the others wait for the refetch.
+func lookupKey(kid string) (interface{}, bool) {
+	jwksMu.Lock()
+	key, ok := jwksKeys[kid]
+	age := clock.Now().Sub(jwksAttempted)
+	done := jwksRefreshing
+
+	refetch := false
+	switch {
+	case !strings.HasPrefix(*jwksSource, "http"):
+	case ok:
+		refetch = age >= *jwksRefresh && done == nil
+	default:
+		// Unknown kids cannot make us hammer the JWKS endpoint, and
+		// neither can a failing endpoint, as failed attempts count too.
+		refetch = age >= jwksMinRefetch || done != nil
+	}
+	if !refetch {
+		jwksMu.Unlock()
+		return key, ok
+	}
+
+	if done == nil {
+		done = make(chan struct{})
+		jwksRefreshing = done
+		jwksAttempted = clock.Now()
+		jwksMu.Unlock()
+
+		if err := loadJWKS(); err != nil {
+			fmt.Printf("Error refreshing JWKS: %v\n", err)
+		}
+
+		jwksMu.Lock()
+		jwksRefreshing = nil
+		close(done)
+	} else {
+		jwksMu.Unlock()
+		<-done
+		jwksMu.Lock()
+	}
+	defer jwksMu.Unlock()
+
+	key, ok = jwksKeys[kid]
+	return key, ok
+}
+
+// verifyJWT checks the signature and standard claims of a compact JWT and
+// returns its claims.
+func verifyJWT(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	digest := sha256.Sum256(signed)
+
+	var key interface{}
+	if header.Alg == "HS256" && *jwtSecret != "" {
+		secret, err := resolveSecrets(*jwtSecret)
+		if err != nil {
+			return nil, err
+		}
+		key = []byte(secret)
+	} else {
+		var ok bool
+		if key, ok = lookupKey(header.Kid); !ok {
+			return nil, fmt.Errorf("unknown key %q", header.Kid)
+		}
+	}
+
+	switch header.Alg {
+	case "RS256":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) != nil {
+			return nil, errors.New("invalid signature")
+		}
+	case "ES256":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return nil, errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return nil, errors.New("invalid signature")
+		}
+	case "HS256":
+		k, ok := key.([]byte)
+		if !ok || !hmac.Equal(signature, hmacSHA256(k, string(signed))) {
+			return nil, errors.New("invalid signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+func checkClaims(claims map[string]interface{}) error {
+	now := clock.Now()
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("missing exp claim")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token not yet valid")
+	}
+
+	if *jwtIssuer != "" && claims["iss"] != *jwtIssuer {
+		return errors.New("invalid issuer")
+	}
+	if *jwtAudience != "" {
+		switch aud := claims["aud"].(type) {
+		case string:
+			if aud != *jwtAudience {
+				return errors.New("invalid audience")
+			}
+		case []interface{}:
+			found := false
+			for _, a := range aud {
+				if a == *jwtAudience {
+					found = true
+				}
+			}
+			if !found {
+				return errors.New("invalid audience")
+			}
+		default:
+			return errors.New("invalid audience")
+		}
+	}
+	return nil
+}
+
+func principalFromClaims(claims map[string]interface{}) *Principal {
+	p := &Principal{Scopes: make(map[string]bool)}
+	p.Subject, _ = claims["sub"].(string)
+	p.Tenant, _ = claims[*jwtTenantClaim].(string)
+
+	if scope, ok := claims["scope"].(string); ok {
+		for _, s := range strings.Fields(scope) {
+			p.Scopes[s] = true
+		}
+	}
+	if scp, ok := claims["scp"].([]interface{}); ok {
+		for _, s := range scp {
+			if s, ok := s.(string); ok {
+				p.Scopes[s] = true
+			}
+		}
+	}
+	return p
+}
+
+// routeScopes maps path prefixes to the scope needed to read (GET) and to
+// modify them. Paths not listed require the admin scope.
+var routeScopes = []struct {
+	prefix      string
+	read, write string
+}{
+	{"/messages/", "messages:read", "messages:write"},
+	{"/kv/", "kv:read", "kv:write"},
+	{"/ids/", "ids:read", "ids:write"},
+	{"/run/", "tasks:read", "tasks:run"},
+	{"/jobs/", "tasks:read", "tasks:run"},
+	{"/wait/", "tasks:read", "tasks:read"},
+	{"/count/", "tasks:read", "tasks:read"},
+	{"/results/", "tasks:read", "tasks:read"},
+	{"/locks/", "coordination:read", "coordination:write"},
+	{"/elections/", "coordination:read", "coordination:write"},
+	{"/semaphores/", "coordination:read", "coordination:write"},
+	{"/waitgroups/", "coordination:read", "coordination:write"},
+	{"/barriers/", "coordination:read", "coordination:write"},
+	{"/counters/", "coordination:read", "coordination:write"},
+	{"/rates/", "coordination:read", "coordination:write"},
+	{"/limiters/", "coordination:read", "coordination:write"},
+}
+
+// tenantRoutes lists the routes of named resources, whose names confine
+// them to a tenant. lists is set when GET on the bare prefix lists the
+// resources, which then only shows those of the caller's tenant.
+// Messages, jobs and results record the tenant that created them instead.
+var tenantRoutes = []struct {
+	prefix string
+	lists  bool
+}{
+	{"/kv/", false},
+	{"/ids/sequences/", true},
+	{"/locks/", true},
+	{"/elections/", true},
+	{"/semaphores/", true},
+	{"/waitgroups/", true},
+	{"/barriers/", true},
+	{"/counters/", true},
+	{"/rates/", false},
+	{"/limiters/", true},
+}
+
+// serverWideRoutes report on the tasks of all tenants. Callers confined to
+// a tenant follow their own tasks through /jobs/ instead.
+var serverWideRoutes = []string{"/wait/", "/count/"}
+
+// checkTenant refuses requests for resources outside the caller's tenant.
+func checkTenant(r *http.Request) error {
+	tenant := requestTenant(r)
+	if tenant == "" {
+		return nil
+	}
+	for _, prefix := range serverWideRoutes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return errors.New("Not available to callers with a tenant")
+		}
+	}
+	for _, route := range tenantRoutes {
+		if !strings.HasPrefix(r.URL.Path, route.prefix) {
+			continue
+		}
+		name := strings.Trim(r.URL.Path[len(route.prefix):], "/")
+		if name == "" && route.lists && r.Method == "GET" {
+			return nil
+		}
+		if !inTenant(tenant, name) {
+			return fmt.Errorf("Names must start with %q", tenant+"/")
+		}
+		return nil
+	}
+	return nil
+}
+
+func requiredScope(r *http.Request) string {
+	for _, route := range routeScopes {
+		if strings.HasPrefix(r.URL.Path, route.prefix) {
+			if r.Method == "GET" || r.Method == "HEAD" {
+				return route.read
+			}
+			return route.write
+		}
+	}
+	return "admin"
+}
+
+// authMiddleware requires a valid bearer JWT carrying the scope of the
+// endpoint on every request, and confines callers with a tenant claim to
+// the resources of their tenant. The admin scope grants access to
+// everything.
+func authMiddleware(next http.Handler) http.Handler {
+	if !authEnabled() {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Missing bearer token", http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := verifyJWT(strings.TrimPrefix(auth, "Bearer "))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "Invalid token: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		p := principalFromClaims(claims)
+		scope := requiredScope(r)
+		if !p.Scopes[scope] && !p.Scopes["admin"] {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+			http.Error(w, "Insufficient scope", http.StatusForbidden)
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+		if err := checkTenant(r); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type ChangeEvent struct {
+	Seq       int64    `json:"seq"`
+	Type      string   `json:"type"`
+	MessageID int      `json:"messageId"`
+	Message   *Message `json:"message,omitempty"`
+	Time      int64    `json:"time"`
+	tenant    string
+}
+
+var (
+	changesRetention       = flag.Int("changes-retention", 10000, "maximum number of change events kept in the change feed")
+	changesMaxAge          = flag.Duration("changes-max-age", 24*time.Hour, "maximum age of change events kept in the change feed")
+	changesCompactInterval = flag.Duration("changes-compact-interval", time.Minute, "how often the change feed is compacted")
+)
+
+// The change log is guarded by messagesMu so events are recorded in the
+// same order the changes are applied to the messages map.
+var (
+	changeLog []ChangeEvent
+	nextSeq   int64 = 1
+	// truncatedSeq is the highest sequence number dropped by retention.
+	// Consumers that are behind it have missed events and must resync.
+	truncatedSeq int64
+	// changeNotify is closed and replaced whenever an event is recorded.
+	changeNotify = make(chan struct{})
+)
+
+func recordChange(kind string, m Message) {
+	e := ChangeEvent{
+		Seq:       nextSeq,
+		Type:      kind,
+		MessageID: m.ID,
+		Time:      clock.Now().UnixNano(),
+		tenant:    m.Tenant,
+	}
+	if kind != "delete" {
+		e.Message = &m
+	}
+	nextSeq++
+
+	changeLog = append(changeLog, e)
+	close(changeNotify)
+	changeNotify = make(chan struct{})
+}
+
+func compactChanges() {
+	messagesMu.Lock()
+	defer messagesMu.Unlock()
+
+	// Retention: drop events that are too old or exceed the maximum count.
+	cutoff := clock.Now().Add(-*changesMaxAge).UnixNano()
+	drop := 0
+	for drop < len(changeLog) && (changeLog[drop].Time < cutoff || len(changeLog)-drop > *changesRetention) {
+		drop++
+	}
+	if drop > 0 {
+		truncatedSeq = changeLog[drop-1].Seq
+		changeLog = changeLog[drop:]
+	}
+
+	// Compaction: only the latest event for each message is needed to
+	// reconstruct the current state.
+	latest := make(map[int]int64, len(changeLog))
+	for _, e := range changeLog {
+		latest[e.MessageID] = e.Seq
+	}
+	compacted := make([]ChangeEvent, 0, len(latest))
+	for _, e := range changeLog {
+		if latest[e.MessageID] == e.Seq {
+			compacted = append(compacted, e)
+		}
+	}
+	changeLog = compacted
+}
+
+func changeCompactor() {
+	for {
+		clock.Sleep(*changesCompactInterval)
+		compactChanges()
+	}
+}
+
+// changesSince returns up to limit events of the tenant's messages with a
+// sequence number greater than since. ok is false if events after since
+// have been truncated.
+func changesSince(tenant string, since int64, limit int) (events []ChangeEvent, notify chan struct{}, ok bool) {
+	messagesMu.Lock()
+	defer messagesMu.Unlock()
+
+	if since < truncatedSeq {
+		return nil, nil, false
+	}
+	for _, e := range changeLog {
+		if e.Seq <= since || !ownedBy(tenant, e.tenant) {
+			continue
+		}
+		if len(events) == limit {
+			break
+		}
+		events = append(events, e)
+	}
+	return events, changeNotify, true
+}
+
+func handleChanges(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var since int64
+	if v := query.Get("since"); v != "" {
+		var err error
+		since, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid since parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := 1000
+	if v := query.Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if query.Get("stream") != "" {
+		streamChanges(w, r, since)
+		return
+	}
+
+	events, _, ok := changesSince(requestTenant(r), since, limit)
+	if !ok {
+		http.Error(w, "Changes have been compacted, resync required", http.StatusGone)
+		return
+	}
+	if events == nil {
+		events = []ChangeEvent{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// streamChanges writes change events as newline-delimited JSON until the
+// client disconnects.
+func streamChanges(w http.ResponseWriter, r *http.Request, since int64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	tenant := requestTenant(r)
+	enc := json.NewEncoder(w)
+	for {
+		events, notify, ok := changesSince(tenant, since, 1000)
+		if !ok {
+			enc.Encode(map[string]string{"error": "Changes have been compacted, resync required"})
+			return
+		}
+		for _, e := range events {
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			since = e.Seq
+		}
+		flusher.Flush()
+
+		if len(events) > 0 {
+			continue
+		}
+		select {
+		case <-notify:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ChaosConfig describes the faults injected into the task engine. Rates are
+// fractions of tasks between 0 and 1; durations are in milliseconds.
+type ChaosConfig struct {
+	Enabled        bool    `json:"enabled"`
+	LatencyRate    float64 `json:"latencyRate"`
+	LatencyMs      int     `json:"latencyMs"`
+	ErrorRate      float64 `json:"errorRate"`
+	PanicRate      float64 `json:"panicRate"`
+	DropAckRate    float64 `json:"dropAckRate"`
+	DequeueDelayMs int     `json:"dequeueDelayMs"`
+}
+
+var (
+	chaos   ChaosConfig
+	chaosMu sync.Mutex
+)
+
+var chaosConfigFile = flag.String("chaos-config", "", "JSON file with the initial fault injection config")
+
+var errInjected = errors.New("injected fault")
+
+func loadChaosConfig() error {
+	if *chaosConfigFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(*chaosConfigFile)
+	if err != nil {
+		return err
+	}
+
+	chaosMu.Lock()
+	defer chaosMu.Unlock()
+	return json.Unmarshal(data, &chaos)
+}
+
+func chaosConfig() ChaosConfig {
+	chaosMu.Lock()
+	defer chaosMu.Unlock()
+	return chaos
+}
+
+// injectFault is called before a task runs. It may delay the task, fail it
+// or panic.
+func injectFault() error {
+	c := chaosConfig()
+	if !c.Enabled {
+		return nil
+	}
+
+	if rand.Float64() < c.LatencyRate {
+		clock.Sleep(time.Duration(c.LatencyMs) * time.Millisecond)
+	}
+	if rand.Float64() < c.PanicRate {
+		panic("injected panic")
+	}
+	if rand.Float64() < c.ErrorRate {
+		return errInjected
+	}
+	return nil
+}
+
+// dropAck reports whether the completion of a task should go unrecorded.
+func dropAck() bool {
+	c := chaosConfig()
+	return c.Enabled && rand.Float64() < c.DropAckRate
+}
+
+// slowDequeue delays workers before they take the next task from the queue.
+func slowDequeue() {
+	c := chaosConfig()
+	if c.Enabled && c.DequeueDelayMs > 0 {
+		clock.Sleep(time.Duration(c.DequeueDelayMs) * time.Millisecond)
+	}
+}
+
+func chaosHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(chaosConfig())
+	case "PUT":
+		var c ChaosConfig
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Error reading request body", http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.Unmarshal(body, &c); err != nil {
+			http.Error(w, "Error parsing request body", http.StatusBadRequest)
+			return
+		}
+
+		chaosMu.Lock()
+		chaos = c
+		chaosMu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for the engine and the message store, so
+// tests can replace wall time with a FakeClock.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+var clock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTimer(d time.Duration) Timer         { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.t.C }
+func (t realTimer) Stop() bool          { return t.t.Stop() }
+
+// FakeClock is a Clock that only moves when Advance is called.
+type FakeClock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	at    time.Time
+	c     chan time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{clock: c, at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+		return t
+	}
+	c.waiters = append(c.waiters, t)
+	c.cond.Broadcast()
+	return t
+}
+
+// Advance moves the clock forward, firing every timer that falls due.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	sort.Slice(c.waiters, func(i, j int) bool { return c.waiters[i].at.Before(c.waiters[j].at) })
+
+	pending := c.waiters[:0]
+	for _, t := range c.waiters {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.c <- t.at
+	}
+	c.waiters = pending
+	c.cond.Broadcast()
+}
+
+// BlockUntil waits until at least n timers or sleeps are pending, so a test
+// can be sure the goroutines it is driving have reached the clock.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.waiters) < n {
+		c.cond.Wait()
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, w := range c.waiters {
+		if w == t {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			c.cond.Broadcast()
+			return true
+		}
+	}
+	return false
+}
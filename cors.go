@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	corsOrigins     = flag.String("cors-origins", "", "comma-separated origins allowed to call the API from a browser, or * for any; enables CORS")
+	corsMethods     = flag.String("cors-methods", "GET, POST, PUT, DELETE", "methods allowed in cross-origin requests")
+	corsHeaders     = flag.String("cors-headers", "Authorization, Content-Type", "request headers allowed in cross-origin requests")
+	corsCredentials = flag.Bool("cors-credentials", false, "allow cross-origin requests with credentials")
+	corsMaxAge      = flag.Duration("cors-max-age", 10*time.Minute, "how long browsers may cache preflight responses")
+)
+
+func corsWildcard() bool {
+	for _, o := range strings.Split(*corsOrigins, ",") {
+		if strings.TrimSpace(o) == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCORSConfig refuses a wildcard origin with credentials, which
+// browsers reject and which would otherwise have to be served by echoing
+// any origin.
+func checkCORSConfig() error {
+	if *corsCredentials && corsWildcard() {
+		return errors.New("-cors-origins=* cannot be combined with -cors-credentials")
+	}
+	return nil
+}
+
+// corsAllowOrigin returns the Access-Control-Allow-Origin value for the
+// origin, or "" if it is not allowed.
+func corsAllowOrigin(origin string) string {
+	for _, o := range strings.Split(*corsOrigins, ",") {
+		if strings.EqualFold(strings.TrimSpace(o), origin) {
+			return origin
+		}
+	}
+	if corsWildcard() {
+		return "*"
+	}
+	return ""
+}
+
+// corsMiddleware adds CORS headers for allowed origins and answers OPTIONS
+// requests itself, including preflights, before they reach authentication
+// or the handlers.
+func corsMiddleware(next http.Handler) http.Handler {
+	if *corsOrigins == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+
+		allowOrigin := ""
+		if origin != "" {
+			allowOrigin = corsAllowOrigin(origin)
+		}
+		allowed := allowOrigin != ""
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+			if *corsCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+
+		if r.Method != "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Allow", "OPTIONS, "+*corsMethods)
+		if allowed && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", *corsMethods)
+			w.Header().Set("Access-Control-Allow-Headers", *corsHeaders)
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Named counters generalize /count/ for clients. Plain counters support
+// atomic updates and may expire; rate counters record events in one-second
+// buckets and report how many happened within a recent window.
+
+var rateMaxWindow = flag.Duration("rate-max-window", time.Hour, "longest window rate counters can be queried over")
+
+const counterSweepInterval = time.Minute
+
+type namedCounter struct {
+	name    string
+	value   int64
+	expires *time.Time
+}
+
+type CounterState struct {
+	Name    string     `json:"name"`
+	Value   int64      `json:"value"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+type rateBucket struct {
+	second int64
+	count  int64
+}
+
+type rateCounter struct {
+	name    string
+	buckets []rateBucket
+}
+
+type RateState struct {
+	Name   string `json:"name"`
+	Window string `json:"window"`
+	Count  int64  `json:"count"`
+	// PerSecond is the average rate over the window.
+	PerSecond float64 `json:"perSecond"`
+}
+
+var (
+	counters     = make(map[string]*namedCounter)
+	rateCounters = make(map[string]*rateCounter)
+	// countersMu guards both counters and rateCounters.
+	countersMu sync.Mutex
+)
+
+func (c *namedCounter) state() CounterState {
+	return CounterState{Name: c.name, Value: c.value, Expires: c.expires}
+}
+
+func (c *namedCounter) expired(now time.Time) bool {
+	return c.expires != nil && !now.Before(*c.expires)
+}
+
+// lookupCounter returns the named counter, forgetting it if it expired.
+// The caller must hold countersMu.
+func lookupCounter(name string) (*namedCounter, bool) {
+	c, ok := counters[name]
+	if ok && c.expired(clock.Now()) {
+		delete(counters, name)
+		return nil, false
+	}
+	return c, ok
+}
+
+// getCounter returns the named counter, creating it at zero. A positive
+// ttl restarts its expiry. The caller must hold countersMu.
+func getCounter(name string, ttl time.Duration) *namedCounter {
+	c, ok := lookupCounter(name)
+	if !ok {
+		c = &namedCounter{name: name}
+		counters[name] = c
+	}
+	if ttl > 0 {
+		expires := clock.Now().Add(ttl)
+		c.expires = &expires
+	}
+	return c
+}
+
+// add records n events in the current second and drops buckets too old to
+// matter. The caller must hold countersMu.
+func (c *rateCounter) add(n int64) {
+	now := clock.Now().Unix()
+	if len(c.buckets) > 0 && c.buckets[len(c.buckets)-1].second == now {
+		c.buckets[len(c.buckets)-1].count += n
+	} else {
+		c.buckets = append(c.buckets, rateBucket{second: now, count: n})
+	}
+	c.prune()
+}
+
+func (c *rateCounter) prune() {
+	oldest := clock.Now().Unix() - int64(rateMaxWindow.Seconds())
+	i := 0
+	for i < len(c.buckets) && c.buckets[i].second <= oldest {
+		i++
+	}
+	c.buckets = c.buckets[i:]
+}
+
+// count returns the events recorded within window of now.
+func (c *rateCounter) count(window time.Duration) int64 {
+	oldest := clock.Now().Unix() - int64(window.Seconds())
+	var total int64
+	for i := len(c.buckets) - 1; i >= 0 && c.buckets[i].second > oldest; i-- {
+		total += c.buckets[i].count
+	}
+	return total
+}
+
+func (c *rateCounter) state(window time.Duration) RateState {
+	n := c.count(window)
+	return RateState{Name: c.name, Window: window.String(), Count: n, PerSecond: float64(n) / window.Seconds()}
+}
+
+// expireCounters periodically forgets expired counters and rate counters
+// without recent events.
+func expireCounters() {
+	for {
+		clock.Sleep(counterSweepInterval)
+
+		countersMu.Lock()
+		now := clock.Now()
+		for name, c := range counters {
+			if c.expired(now) {
+				delete(counters, name)
+			}
+		}
+		for name, c := range rateCounters {
+			c.prune()
+			if len(c.buckets) == 0 {
+				delete(rateCounters, name)
+			}
+		}
+		countersMu.Unlock()
+	}
+}
+
+func counterHandler(w http.ResponseWriter, r *http.Request) {
+	name, action := splitAction(r.URL.Path, "/counters/", "add", "incr", "decr", "cas", "reset")
+	if name == "" && r.Method == "GET" {
+		handleListCounters(w, r)
+		return
+	}
+	if name == "" {
+		http.Error(w, "Missing counter name", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == "GET":
+		countersMu.Lock()
+		c, ok := lookupCounter(name)
+		var s CounterState
+		if ok {
+			s = c.state()
+		}
+		countersMu.Unlock()
+		if !ok {
+			http.Error(w, "Counter not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	case action == "" && r.Method == "DELETE":
+		countersMu.Lock()
+		delete(counters, name)
+		countersMu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	case action != "" && r.Method == "POST":
+		handleUpdateCounter(w, r, name, action)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleListCounters(w http.ResponseWriter, r *http.Request) {
+	tenant := requestTenant(r)
+	countersMu.Lock()
+	defer countersMu.Unlock()
+
+	now := clock.Now()
+	list := make([]CounterState, 0, len(counters))
+	for _, c := range counters {
+		if !c.expired(now) && inTenant(tenant, c.name) {
+			list = append(list, c.state())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleUpdateCounter applies an atomic update. Every update may set a
+// ttlSeconds after which the counter expires; reset answers with the value
+// before the reset.
+func handleUpdateCounter(w http.ResponseWriter, r *http.Request, name, action string) {
+	var request struct {
+		Delta      *int64 `json:"delta"`
+		Expected   int64  `json:"expected"`
+		Value      int64  `json:"value"`
+		TTLSeconds int    `json:"ttlSeconds"`
+	}
+	if !readJSONBody(w, r, &request) {
+		return
+	}
+	ttl := time.Duration(request.TTLSeconds) * time.Second
+
+	countersMu.Lock()
+	defer countersMu.Unlock()
+
+	c := getCounter(name, ttl)
+	switch action {
+	case "add":
+		if request.Delta == nil {
+			http.Error(w, "Missing delta", http.StatusBadRequest)
+			return
+		}
+		c.value += *request.Delta
+	case "incr":
+		c.value++
+	case "decr":
+		c.value--
+	case "cas":
+		if c.value != request.Expected {
+			writeJSON(w, http.StatusConflict, c.state())
+			return
+		}
+		c.value = request.Value
+	case "reset":
+		s := c.state()
+		c.value = 0
+		writeJSON(w, http.StatusOK, s)
+		return
+	}
+	writeJSON(w, http.StatusOK, c.state())
+}
+
+func rateHandler(w http.ResponseWriter, r *http.Request) {
+	name, action := splitAction(r.URL.Path, "/rates/", "add")
+	if name == "" {
+		http.Error(w, "Missing rate counter name", http.StatusBadRequest)
+		return
+	}
+
+	window := time.Minute
+	if v := r.URL.Query().Get("window"); v != "" {
+		var err error
+		window, err = time.ParseDuration(v)
+		if err != nil || window < time.Second || window > *rateMaxWindow {
+			http.Error(w, "Invalid window parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch {
+	case action == "" && r.Method == "GET":
+		countersMu.Lock()
+		c, ok := rateCounters[name]
+		s := RateState{Name: name, Window: window.String()}
+		if ok {
+			s = c.state(window)
+		}
+		countersMu.Unlock()
+		writeJSON(w, http.StatusOK, s)
+	case action == "" && r.Method == "DELETE":
+		countersMu.Lock()
+		delete(rateCounters, name)
+		countersMu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	case action == "add" && r.Method == "POST":
+		n := int64(1)
+		if v := r.URL.Query().Get("n"); v != "" {
+			var err error
+			n, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				http.Error(w, "Invalid n parameter", http.StatusBadRequest)
+				return
+			}
+		}
+
+		countersMu.Lock()
+		c, ok := rateCounters[name]
+		if !ok {
+			c = &rateCounter{name: name}
+			rateCounters[name] = c
+		}
+		c.add(n)
+		s := c.state(window)
+		countersMu.Unlock()
+		writeJSON(w, http.StatusOK, s)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
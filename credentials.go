@@ -0,0 +1,486 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CredentialProfile describes how requests made by tasks referencing it
+// are authenticated. Type is one of "oauth2" (client credentials),
+// "bearer", "basic", "hmac" or "sigv4".
+type CredentialProfile struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+
+	TokenURL     string   `json:"tokenUrl,omitempty"`
+	ClientID     string   `json:"clientId,omitempty"`
+	ClientSecret string   `json:"clientSecret,omitempty"`
+	Scopes       []string `json:"scopes,omitempty"`
+
+	Token    string `json:"token,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// Key signs hmac requests; the signature is sent in Header, which
+	// defaults to X-Signature.
+	Key    string `json:"key,omitempty"`
+	Header string `json:"header,omitempty"`
+
+	AccessKeyID     string `json:"accessKeyId,omitempty"`
+	SecretAccessKey string `json:"secretAccessKey,omitempty"`
+	Region          string `json:"region,omitempty"`
+	Service         string `json:"service,omitempty"`
+}
+
+// cachedToken is an OAuth2 access token shared by every worker using the
+// profile. Its mutex makes concurrent workers wait for a single refresh.
+type cachedToken struct {
+	mu    sync.Mutex
+	token string
+	// refresh is when the token is replaced, shortly before it expires.
+	refresh time.Time
+}
+
+var (
+	credentials   = make(map[string]CredentialProfile)
+	tokens        = make(map[string]*cachedToken)
+	credentialsMu sync.Mutex
+)
+
+var credentialsFile = flag.String("credentials", "", "JSON file with a list of credential profiles")
+
+const (
+	// tokenExpirySkew refreshes tokens slightly before they expire, but
+	// never earlier than maxTokenSkewFraction into their lifetime, so
+	// short-lived tokens are still reused.
+	tokenExpirySkew      = 30 * time.Second
+	maxTokenSkewFraction = 0.25
+	// tokenTimeout bounds token requests, which are made while every
+	// worker using the profile waits for the token.
+	tokenTimeout = 30 * time.Second
+)
+
+var tokenClient = &http.Client{Timeout: tokenTimeout}
+
+func loadCredentials() error {
+	if *credentialsFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(*credentialsFile)
+	if err != nil {
+		return err
+	}
+
+	var list []CredentialProfile
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	for _, p := range list {
+		if err := validateProfile(p); err != nil {
+			return fmt.Errorf("profile %s: %v", p.Name, err)
+		}
+		setCredentialProfile(p)
+	}
+	return nil
+}
+
+func validateProfile(p CredentialProfile) error {
+	switch p.Type {
+	case "oauth2":
+		if p.TokenURL == "" || p.ClientID == "" {
+			return errors.New("oauth2 profiles need tokenUrl and clientId")
+		}
+	case "bearer":
+		if p.Token == "" {
+			return errors.New("bearer profiles need a token")
+		}
+	case "basic":
+		if p.Username == "" {
+			return errors.New("basic profiles need a username")
+		}
+	case "hmac":
+		if p.Key == "" {
+			return errors.New("hmac profiles need a key")
+		}
+	case "sigv4":
+		if p.AccessKeyID == "" || p.SecretAccessKey == "" || p.Region == "" || p.Service == "" {
+			return errors.New("sigv4 profiles need accessKeyId, secretAccessKey, region and service")
+		}
+	default:
+		return fmt.Errorf("unknown type %q", p.Type)
+	}
+	return nil
+}
+
+func setCredentialProfile(p CredentialProfile) {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+
+	credentials[p.Name] = p
+	tokens[p.Name] = &cachedToken{}
+}
+
+func credentialProfile(name string) (CredentialProfile, *cachedToken, bool) {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+
+	p, ok := credentials[name]
+	return p, tokens[name], ok
+}
+
+// authorize adds the credentials of the named profile to the request.
+func authorize(req *http.Request, name string) error {
+	if name == "" {
+		return nil
+	}
+
+	p, cache, ok := credentialProfile(name)
+	if !ok {
+		return fmt.Errorf("unknown credential profile %q", name)
+	}
+	p, err := p.resolved()
+	if err != nil {
+		return fmt.Errorf("credential profile %s: %v", name, err)
+	}
+
+	switch p.Type {
+	case "oauth2":
+		token, err := cache.get(p)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	case "bearer":
+		req.Header.Set("Authorization", "Bearer "+p.Token)
+	case "basic":
+		req.SetBasicAuth(p.Username, p.Password)
+	case "hmac":
+		return signHMAC(req, p)
+	case "sigv4":
+		return signSigV4(req, p)
+	}
+	return nil
+}
+
+// get returns the cached token, fetching a new one if it is missing or
+// about to expire.
+func (c *cachedToken) get(p CredentialProfile) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && clock.Now().Before(c.refresh) {
+		return c.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(p.Scopes) > 0 {
+		form.Set("scope", strings.Join(p.Scopes, " "))
+	}
+	req, err := http.NewRequest("POST", p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	resp, err := tokenClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetching token for %s: %v", p.Name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching token for %s: %s", p.Name, resp.Status)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("parsing token for %s: %v", p.Name, err)
+	}
+	if body.AccessToken == "" {
+		return "", fmt.Errorf("no access token for %s", p.Name)
+	}
+
+	lifetime := time.Duration(body.ExpiresIn) * time.Second
+	if body.ExpiresIn == 0 {
+		lifetime = time.Hour
+	}
+	skew := tokenExpirySkew
+	if max := time.Duration(float64(lifetime) * maxTokenSkewFraction); skew > max {
+		skew = max
+	}
+	c.token = body.AccessToken
+	c.refresh = clock.Now().Add(lifetime - skew)
+	return c.token, nil
+}
+
+func (c *cachedToken) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = ""
+}
+
+func requestBody(req *http.Request) ([]byte, error) {
+	if req.GetBody == nil {
+		return nil, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signHMAC signs the method, path, timestamp and body hash of the request
+// with the profile key.
+func signHMAC(req *http.Request, p CredentialProfile) error {
+	body, err := requestBody(req)
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(clock.Now().Unix(), 10)
+	payload := strings.Join([]string{req.Method, req.URL.RequestURI(), timestamp, sha256Hex(body)}, "\n")
+
+	header := p.Header
+	if header == "" {
+		header = "X-Signature"
+	}
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set(header, hex.EncodeToString(hmacSHA256([]byte(p.Key), payload)))
+	return nil
+}
+
+// signSigV4 signs the request with AWS Signature Version 4.
+func signSigV4(req *http.Request, p CredentialProfile) error {
+	body, err := requestBody(req)
+	if err != nil {
+		return err
+	}
+
+	now := clock.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(req.Header.Get(k))
+	}
+	delete(headers, "authorization")
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, sigV4Escape(k)+"="+sigV4Escape(v))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, strings.Join(params, "&"), canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+
+	scope := date + "/" + p.Region + "/" + p.Service + "/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+p.SecretAccessKey), date)
+	key = hmacSHA256(key, p.Region)
+	key = hmacSHA256(key, p.Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		p.AccessKeyID, scope, signedHeaders, signature))
+	return nil
+}
+
+func sigV4Escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// doWithCredentials sends the request with the named profile, retrying once
+// with a fresh token if an OAuth2 token is rejected.
+func doWithCredentials(client *http.Client, req *http.Request, name string) (*http.Response, error) {
+	if err := authorize(req, name); err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	p, cache, _ := credentialProfile(name)
+	if p.Type != "oauth2" {
+		return resp, nil
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	cache.invalidate()
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		retry.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := authorize(retry, name); err != nil {
+		return nil, err
+	}
+	return client.Do(retry)
+}
+
+// resolved returns the profile with secret references replaced by their
+// values.
+func (p CredentialProfile) resolved() (CredentialProfile, error) {
+	fields := []*string{
+		&p.ClientID, &p.ClientSecret, &p.Token, &p.Username, &p.Password,
+		&p.Key, &p.AccessKeyID, &p.SecretAccessKey,
+	}
+	for _, f := range fields {
+		v, err := resolveSecrets(*f)
+		if err != nil {
+			return p, err
+		}
+		*f = v
+	}
+	return p, nil
+}
+
+// redacted returns the profile with its secrets masked.
+func (p CredentialProfile) redacted() CredentialProfile {
+	mask := func(s string) string {
+		if s == "" {
+			return ""
+		}
+		return "****"
+	}
+	p.ClientSecret = mask(p.ClientSecret)
+	p.Token = mask(p.Token)
+	p.Password = mask(p.Password)
+	p.Key = mask(p.Key)
+	p.SecretAccessKey = mask(p.SecretAccessKey)
+	return p
+}
+
+func credentialsHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Path[len("/credentials/"):]
+
+	switch r.Method {
+	case "GET":
+		credentialsMu.Lock()
+		list := make([]CredentialProfile, 0, len(credentials))
+		for _, p := range credentials {
+			if name == "" || p.Name == name {
+				list = append(list, p.redacted())
+			}
+		}
+		credentialsMu.Unlock()
+
+		if name != "" && len(list) == 0 {
+			http.Error(w, "Credential profile not found", http.StatusNotFound)
+			return
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case "PUT":
+		var p CredentialProfile
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Error reading request body", http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.Unmarshal(body, &p); err != nil {
+			http.Error(w, "Error parsing request body", http.StatusBadRequest)
+			return
+		}
+
+		p.Name = name
+		if name == "" {
+			http.Error(w, "Missing profile name", http.StatusBadRequest)
+			return
+		}
+		if err := validateProfile(p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		setCredentialProfile(p)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.redacted())
+	case "DELETE":
+		credentialsMu.Lock()
+		defer credentialsMu.Unlock()
+
+		if _, ok := credentials[name]; !ok {
+			http.Error(w, "Credential profile not found", http.StatusNotFound)
+			return
+		}
+		delete(credentials, name)
+		delete(tokens, name)
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
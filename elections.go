@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// An election has at most one leader, which holds a lease like a lock
+// holder does. Each new leader starts a new term. Candidates that campaign
+// while there is a leader queue up and take over in order when the leader
+// resigns or its lease expires.
+type election struct {
+	name       string
+	leader     *lease
+	term       int64
+	version    int64
+	candidates []*candidate
+	// changed is closed and replaced whenever the leadership changes.
+	changed chan struct{}
+}
+
+type candidate struct {
+	name    string
+	ttl     time.Duration
+	elected chan ElectionState
+}
+
+type ElectionState struct {
+	Name    string     `json:"name"`
+	Leader  string     `json:"leader,omitempty"`
+	LeaseID string     `json:"leaseId,omitempty"`
+	Term    int64      `json:"term"`
+	Expires *time.Time `json:"expires,omitempty"`
+	// Version increases on every change of leadership, including the
+	// leader going away without a successor.
+	Version    int64 `json:"version"`
+	Candidates int   `json:"candidates"`
+}
+
+// Elections are created by the first campaign and never forgotten, so
+// their terms keep increasing.
+var (
+	elections = make(map[string]*election)
+	// electionCreated is closed and replaced whenever an election is
+	// created, waking observers of elections that did not exist yet.
+	electionCreated = make(chan struct{})
+	electionsMu     sync.Mutex
+)
+
+// getElection returns the named election, creating it without a leader.
+// The caller must hold electionsMu.
+func getElection(name string) *election {
+	e, ok := elections[name]
+	if !ok {
+		e = &election{name: name, changed: make(chan struct{})}
+		elections[name] = e
+		close(electionCreated)
+		electionCreated = make(chan struct{})
+	}
+	return e
+}
+
+// observeElection returns the state of the named election, which is empty
+// if nobody has campaigned yet, and a channel closed when it changes. The
+// caller must hold electionsMu.
+func observeElection(name string) (ElectionState, chan struct{}) {
+	e, ok := elections[name]
+	if !ok {
+		return ElectionState{Name: name}, electionCreated
+	}
+	return e.state(false), e.changed
+}
+
+// state describes the election. The lease ID is only included for the new
+// leader. The caller must hold electionsMu.
+func (e *election) state(withLease bool) ElectionState {
+	s := ElectionState{Name: e.name, Term: e.term, Version: e.version, Candidates: len(e.candidates)}
+	if e.leader != nil {
+		expires := e.leader.Expires
+		s.Leader = e.leader.Holder
+		s.Expires = &expires
+		if withLease {
+			s.LeaseID = e.leader.ID
+		}
+	}
+	return s
+}
+
+func (e *election) notify() {
+	e.version++
+	close(e.changed)
+	e.changed = make(chan struct{})
+}
+
+// elect makes the candidate leader for a new term. The caller must hold
+// electionsMu.
+func (e *election) elect(name string, ttl time.Duration) ElectionState {
+	e.term++
+	e.leader = newLease(name, ttl)
+	e.leader.watch(&electionsMu, func() {
+		fmt.Printf("Leader lease expired: %s: %s\n", e.name, name)
+		e.resign()
+	})
+	e.notify()
+	return e.state(true)
+}
+
+// resign ends the current term and elects the next candidate, if any. The
+// caller must hold electionsMu.
+func (e *election) resign() {
+	if e.leader != nil {
+		e.leader.end()
+		e.leader = nil
+	}
+
+	if len(e.candidates) > 0 {
+		c := e.candidates[0]
+		e.candidates = e.candidates[1:]
+		c.elected <- e.elect(c.name, c.ttl)
+		return
+	}
+	e.notify()
+}
+
+func (e *election) withdraw(c *candidate) bool {
+	for i, other := range e.candidates {
+		if other == c {
+			e.candidates = append(e.candidates[:i], e.candidates[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func electionHandler(w http.ResponseWriter, r *http.Request) {
+	name, action := splitAction(r.URL.Path, "/elections/", "campaign", "renew", "resign")
+	if name == "" && r.Method == "GET" {
+		handleListElections(w, r)
+		return
+	}
+	if name == "" {
+		http.Error(w, "Missing election name", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == "GET":
+		if r.URL.Query().Get("stream") != "" {
+			streamElection(w, r, name)
+		} else {
+			handleObserveElection(w, r, name)
+		}
+	case action == "campaign" && r.Method == "POST":
+		handleCampaign(w, r, name)
+	case action == "renew" && r.Method == "POST":
+		handleRenewLeadership(w, r, name)
+	case action == "resign" && r.Method == "POST":
+		handleResign(w, r, name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleListElections(w http.ResponseWriter, r *http.Request) {
+	tenant := requestTenant(r)
+	electionsMu.Lock()
+	defer electionsMu.Unlock()
+
+	list := make([]ElectionState, 0, len(elections))
+	for name, e := range elections {
+		if inTenant(tenant, name) {
+			list = append(list, e.state(false))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleObserveElection returns the election state. Given the version a
+// client last saw, it long-polls until the leadership changes or the
+// timeout passes.
+func handleObserveElection(w http.ResponseWriter, r *http.Request, name string) {
+	query := r.URL.Query()
+
+	version := int64(-1)
+	if v := query.Get("version"); v != "" {
+		var err error
+		version, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid version parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	timeout, ok := waitTimeout(r)
+	if !ok {
+		http.Error(w, "Invalid timeout parameter", http.StatusBadRequest)
+		return
+	}
+
+	electionsMu.Lock()
+	s, changed := observeElection(name)
+	electionsMu.Unlock()
+	if version < 0 || s.Version != version {
+		writeJSON(w, http.StatusOK, s)
+		return
+	}
+
+	waitFor(r, changed, timeout)
+
+	electionsMu.Lock()
+	s, _ = observeElection(name)
+	electionsMu.Unlock()
+	writeJSON(w, http.StatusOK, s)
+}
+
+// streamElection writes the election state as newline-delimited JSON, once
+// on connecting and again on every change of leadership.
+func streamElection(w http.ResponseWriter, r *http.Request, name string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	// Until the election exists, the creation of other elections wakes us
+	// without anything to send.
+	sent := int64(-1)
+	for {
+		electionsMu.Lock()
+		s, changed := observeElection(name)
+		electionsMu.Unlock()
+
+		if s.Version != sent {
+			if err := enc.Encode(s); err != nil {
+				return
+			}
+			flusher.Flush()
+			sent = s.Version
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// handleCampaign makes the caller leader if there is none. Otherwise it
+// fails at once, or waits up to waitSeconds to be elected.
+func handleCampaign(w http.ResponseWriter, r *http.Request, name string) {
+	var request struct {
+		Candidate   string `json:"candidate"`
+		TTLSeconds  int    `json:"ttlSeconds"`
+		WaitSeconds int    `json:"waitSeconds"`
+	}
+	if !readJSONBody(w, r, &request) {
+		return
+	}
+	if request.Candidate == "" {
+		http.Error(w, "Missing candidate", http.StatusBadRequest)
+		return
+	}
+	ttl := seconds(request.TTLSeconds, defaultLeaseTTL)
+
+	electionsMu.Lock()
+	e := getElection(name)
+	if e.leader == nil && len(e.candidates) == 0 {
+		s := e.elect(request.Candidate, ttl)
+		electionsMu.Unlock()
+		writeJSON(w, http.StatusOK, s)
+		return
+	}
+	if request.WaitSeconds <= 0 {
+		s := e.state(false)
+		electionsMu.Unlock()
+		writeJSON(w, http.StatusConflict, s)
+		return
+	}
+
+	c := &candidate{name: request.Candidate, ttl: ttl, elected: make(chan ElectionState, 1)}
+	e.candidates = append(e.candidates, c)
+	electionsMu.Unlock()
+
+	timer := clock.NewTimer(time.Duration(request.WaitSeconds) * time.Second)
+	defer timer.Stop()
+
+	select {
+	case s := <-c.elected:
+		writeJSON(w, http.StatusOK, s)
+		return
+	case <-timer.C():
+	case <-r.Context().Done():
+	}
+
+	electionsMu.Lock()
+	defer electionsMu.Unlock()
+
+	if e.withdraw(c) {
+		writeJSON(w, http.StatusConflict, e.state(false))
+		return
+	}
+
+	// The candidate was elected while we gave up waiting. Its term may
+	// have ended meanwhile, so it only resigns if still the leader.
+	s := <-c.elected
+	if r.Context().Err() != nil {
+		if e.leader != nil && e.leader.ID == s.LeaseID {
+			e.resign()
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+func handleRenewLeadership(w http.ResponseWriter, r *http.Request, name string) {
+	var request struct {
+		LeaseID    string `json:"leaseId"`
+		TTLSeconds int    `json:"ttlSeconds"`
+	}
+	if !readJSONBody(w, r, &request) {
+		return
+	}
+
+	electionsMu.Lock()
+	defer electionsMu.Unlock()
+
+	e, ok := elections[name]
+	if !ok || e.leader == nil || e.leader.ID != request.LeaseID {
+		http.Error(w, "Not the leader", http.StatusConflict)
+		return
+	}
+
+	e.leader.renew(seconds(request.TTLSeconds, defaultLeaseTTL))
+	writeJSON(w, http.StatusOK, e.state(true))
+}
+
+func handleResign(w http.ResponseWriter, r *http.Request, name string) {
+	var request struct {
+		LeaseID string `json:"leaseId"`
+	}
+	if !readJSONBody(w, r, &request) {
+		return
+	}
+
+	electionsMu.Lock()
+	defer electionsMu.Unlock()
+
+	e, ok := elections[name]
+	if !ok || e.leader == nil || e.leader.ID != request.LeaseID {
+		http.Error(w, "Not the leader", http.StatusConflict)
+		return
+	}
+
+	e.resign()
+	w.WriteHeader(http.StatusOK)
+}
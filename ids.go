@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The ID service hands out IDs from named sequences and time-sortable
+// unique IDs. Sequences reserve IDs in blocks and persist the end of the
+// reserved range, so after a restart they continue past anything handed
+// out before, at the cost of skipping the unused rest of the block.
+
+var (
+	idsFile     = flag.String("ids-file", "ids.json", "file the reserved ranges of ID sequences are stored in; empty to keep them in memory")
+	idBlockSize = flag.Int64("id-block-size", 1000, "number of sequence IDs reserved per write of the ids file")
+	nodeID      = flag.Int64("node-id", 0, "node ID (0-1023) embedded in snowflake IDs; must be unique per server")
+)
+
+const (
+	maxIDCount   = 10000
+	snowflakeMax = 1<<10 - 1
+	// messageSequence is the sequence message IDs are taken from.
+	messageSequence = "messages"
+)
+
+// snowflakeEpoch is the start of snowflake timestamps.
+var snowflakeEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type sequence struct {
+	next     int64
+	reserved int64
+}
+
+var (
+	sequences = make(map[string]*sequence)
+	// lastULIDTime and lastULIDEntropy make ULIDs generated within the same
+	// millisecond increase monotonically.
+	lastULIDTime    int64
+	lastULIDEntropy [10]byte
+	// lastSnowflakeTime and snowflakeSeq number snowflakes within the same
+	// millisecond.
+	lastSnowflakeTime int64
+	snowflakeSeq      int64
+	idsMu             sync.Mutex
+)
+
+// loadIDs restores the reserved ranges of the sequences.
+func loadIDs() error {
+	if *nodeID < 0 || *nodeID > snowflakeMax {
+		return fmt.Errorf("node ID %d out of range", *nodeID)
+	}
+	if *idBlockSize <= 0 {
+		return fmt.Errorf("ID block size must be positive")
+	}
+	if *idsFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(*idsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var reserved map[string]int64
+	if err := json.Unmarshal(data, &reserved); err != nil {
+		return fmt.Errorf("parsing %s: %v", *idsFile, err)
+	}
+
+	idsMu.Lock()
+	defer idsMu.Unlock()
+
+	for name, r := range reserved {
+		sequences[name] = &sequence{next: r + 1, reserved: r}
+	}
+	return nil
+}
+
+// saveIDs atomically rewrites the ids file. The caller must hold idsMu.
+func saveIDs() error {
+	if *idsFile == "" {
+		return nil
+	}
+
+	reserved := make(map[string]int64, len(sequences))
+	for name, s := range sequences {
+		reserved[name] = s.reserved
+	}
+	data, err := json.MarshalIndent(reserved, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := *idsFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, *idsFile)
+}
+
+// nextSequenceIDs takes count consecutive IDs from the named sequence,
+// which starts at 1, and returns the first.
+func nextSequenceIDs(name string, count int64) (int64, error) {
+	idsMu.Lock()
+	defer idsMu.Unlock()
+
+	s, ok := sequences[name]
+	if !ok {
+		s = &sequence{next: 1}
+		sequences[name] = s
+	}
+
+	last := s.next + count - 1
+	if last > s.reserved {
+		previous := s.reserved
+		for s.reserved < last {
+			s.reserved += *idBlockSize
+		}
+		if err := saveIDs(); err != nil {
+			s.reserved = previous
+			return 0, err
+		}
+	}
+
+	first := s.next
+	s.next += count
+	return first, nil
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID returns a ULID: a 48-bit millisecond timestamp followed by 80
+// random bits, in Crockford base32. Within a millisecond the random part
+// is incremented so IDs stay sorted. The caller must hold idsMu.
+func newULID() string {
+	ms := clock.Now().UnixMilli()
+	if ms <= lastULIDTime {
+		ms = lastULIDTime
+		for i := len(lastULIDEntropy) - 1; i >= 0; i-- {
+			lastULIDEntropy[i]++
+			if lastULIDEntropy[i] != 0 {
+				break
+			}
+			if i == 0 {
+				// The random part overflowed; borrow the next millisecond.
+				ms++
+			}
+		}
+	} else {
+		rand.Read(lastULIDEntropy[:])
+	}
+	lastULIDTime = ms
+
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], uint64(ms)<<16)
+	copy(id[6:], lastULIDEntropy[:])
+
+	// The 128 bits are encoded as 26 characters of 5 bits each.
+	n := new(big.Int).SetBytes(id[:])
+	digit := new(big.Int)
+	encoded := make([]byte, 26)
+	for i := len(encoded) - 1; i >= 0; i-- {
+		n.DivMod(n, big.NewInt(32), digit)
+		encoded[i] = crockford[digit.Int64()]
+	}
+	return string(encoded)
+}
+
+// newSnowflake returns a 63-bit ID made of a 41-bit millisecond timestamp
+// since snowflakeEpoch, the 10-bit node ID and a 12-bit sequence number.
+// When more than 4096 IDs are needed in a millisecond, or the clock goes
+// back, the timestamp runs ahead of the clock instead of waiting. The
+// caller must hold idsMu.
+func newSnowflake() int64 {
+	ms := clock.Now().Sub(snowflakeEpoch).Milliseconds()
+	if ms <= lastSnowflakeTime {
+		ms = lastSnowflakeTime
+		snowflakeSeq++
+		if snowflakeSeq == 1<<12 {
+			ms++
+			snowflakeSeq = 0
+		}
+	} else {
+		snowflakeSeq = 0
+	}
+	lastSnowflakeTime = ms
+	return ms<<22 | *nodeID<<12 | snowflakeSeq
+}
+
+func idCount(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	count := int64(1)
+	if v := r.URL.Query().Get("count"); v != "" {
+		var err error
+		count, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || count <= 0 || count > maxIDCount {
+			http.Error(w, "Invalid count parameter", http.StatusBadRequest)
+			return 0, false
+		}
+	}
+	return count, true
+}
+
+func idsHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path[len("/ids/"):]
+
+	switch {
+	case strings.HasPrefix(path, "sequences/") && r.Method == "GET":
+		handleGetSequences(w, r, path[len("sequences/"):])
+	case strings.HasPrefix(path, "sequences/") && r.Method == "POST":
+		handleNextSequence(w, r, path[len("sequences/"):])
+	case (path == "ulid" || path == "snowflake") && r.Method == "POST":
+		count, ok := idCount(w, r)
+		if !ok {
+			return
+		}
+
+		ids := make([]string, count)
+		idsMu.Lock()
+		for i := range ids {
+			if path == "ulid" {
+				ids[i] = newULID()
+			} else {
+				ids[i] = strconv.FormatInt(newSnowflake(), 10)
+			}
+		}
+		idsMu.Unlock()
+		writeJSON(w, http.StatusOK, map[string][]string{"ids": ids})
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+type SequenceState struct {
+	Name     string `json:"name"`
+	Next     int64  `json:"next"`
+	Reserved int64  `json:"reserved"`
+}
+
+func handleGetSequences(w http.ResponseWriter, r *http.Request, name string) {
+	tenant := requestTenant(r)
+	idsMu.Lock()
+	defer idsMu.Unlock()
+
+	if name != "" {
+		s, ok := sequences[name]
+		if !ok {
+			http.Error(w, "Sequence not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, SequenceState{Name: name, Next: s.next, Reserved: s.reserved})
+		return
+	}
+
+	list := make([]SequenceState, 0, len(sequences))
+	for name, s := range sequences {
+		if inTenant(tenant, name) {
+			list = append(list, SequenceState{Name: name, Next: s.next, Reserved: s.reserved})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJSON(w, http.StatusOK, list)
+}
+
+func handleNextSequence(w http.ResponseWriter, r *http.Request, name string) {
+	if name == "" {
+		http.Error(w, "Missing sequence name", http.StatusBadRequest)
+		return
+	}
+	count, ok := idCount(w, r)
+	if !ok {
+		return
+	}
+
+	first, err := nextSequenceIDs(name, count)
+	if err != nil {
+		fmt.Printf("Error reserving IDs: %v\n", err)
+		http.Error(w, "Error reserving IDs", http.StatusInternalServerError)
+		return
+	}
+
+	ids := make([]int64, count)
+	for i := range ids {
+		ids[i] = first + int64(i)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "ids": ids})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+)
+
+// Workers take tasks from the active jobs rather than from a single FIFO
+// queue, so jobs submitted later do not wait for earlier ones to drain.
+// Jobs are picked by stride scheduling: each job has a pass that advances
+// by one over its weight whenever one of its tasks is dispatched, and the
+// eligible job with the lowest pass goes next. Under round-robin every
+// job advances by one, whatever its weight. A job at its maximum
+// concurrency is skipped until one of its tasks finishes.
+
+var schedulingPolicy = flag.String("scheduling", "weighted", "how workers share out tasks between jobs: weighted or round-robin")
+
+var (
+	// activeJobs are the jobs with queued tasks, in submission order.
+	activeJobs []*Job
+	// virtualPass is the pass of the most recently dispatched job. Jobs
+	// joining start from it, so they get neither a backlog of turns nor
+	// wait for the others to catch up.
+	virtualPass float64
+	// jobsReady is signalled when a task may have become runnable.
+	jobsReady = sync.NewCond(&jobsMu)
+)
+
+func checkSchedulingPolicy() error {
+	if *schedulingPolicy != "weighted" && *schedulingPolicy != "round-robin" {
+		return fmt.Errorf("unknown scheduling policy %q", *schedulingPolicy)
+	}
+	return nil
+}
+
+// activate queues the tasks of a new job. The caller must hold jobsMu.
+func (j *Job) activate() {
+	j.pass = virtualPass
+	activeJobs = append(activeJobs, j)
+	jobsReady.Broadcast()
+}
+
+// deactivate removes a job without queued tasks. The caller must hold
+// jobsMu.
+func (j *Job) deactivate() {
+	for i, other := range activeJobs {
+		if other == j {
+			activeJobs = append(activeJobs[:i], activeJobs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (j *Job) runnable() bool {
+	return j.Queued > 0 && (j.MaxConcurrency == 0 || j.Running < j.MaxConcurrency)
+}
+
+// nextJobTask blocks until a task can run and returns its job, counting
+// the task as running.
+func nextJobTask() *Job {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	for {
+		var next *Job
+		for _, j := range activeJobs {
+			if j.runnable() && (next == nil || j.pass < next.pass) {
+				next = j
+			}
+		}
+		if next == nil {
+			jobsReady.Wait()
+			continue
+		}
+
+		virtualPass = next.pass
+		if *schedulingPolicy == "round-robin" {
+			next.pass++
+		} else {
+			next.pass += 1 / float64(next.weight())
+		}
+		next.Queued--
+		next.Running++
+		if next.Queued == 0 {
+			next.deactivate()
+		}
+		return next
+	}
+}
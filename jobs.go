@@ -0,0 +1,316 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A job is the set of task copies queued by one /run/ request. Jobs can be
+// given failure thresholds and a deadline; once one is crossed the job is
+// aborted, its queued tasks are drained without running, and the reason is
+// reported with the job.
+
+var jobsRetention = flag.Int("jobs-retention", 1000, "number of finished jobs kept for inspection")
+
+const (
+	defaultErrorRateWindow = time.Minute
+	defaultMinSamples      = 10
+)
+
+type JobOptions struct {
+	// MaxFailures aborts the job once this many tasks failed.
+	MaxFailures int `json:"maxFailures,omitempty"`
+	// MaxErrorRate aborts the job once the share of failed tasks among
+	// those finished within the error rate window exceeds it, provided at
+	// least MinSamples tasks finished within the window.
+	MaxErrorRate           float64 `json:"maxErrorRate,omitempty"`
+	ErrorRateWindowSeconds int     `json:"errorRateWindowSeconds,omitempty"`
+	MinSamples             int     `json:"minSamples,omitempty"`
+	// DeadlineSeconds aborts the job if it has not finished in time.
+	DeadlineSeconds int `json:"deadlineSeconds,omitempty"`
+	// Weight is the job's share of the workers relative to other jobs
+	// under weighted scheduling, by default 1.
+	Weight int `json:"weight,omitempty"`
+	// MaxConcurrency limits how many of the job's tasks run at once.
+	MaxConcurrency int `json:"maxConcurrency,omitempty"`
+}
+
+type Job struct {
+	ID    int64 `json:"id"`
+	Task  Task  `json:"task"`
+	Count int   `json:"count"`
+	JobOptions
+	// State is running, completed or aborted.
+	State     string     `json:"state"`
+	Reason    string     `json:"reason,omitempty"`
+	Queued    int        `json:"queued"`
+	Running   int        `json:"running"`
+	Succeeded int        `json:"succeeded"`
+	Failed    int        `json:"failed"`
+	Drained   int        `json:"drained"`
+	Created   time.Time  `json:"created"`
+	Finished  *time.Time `json:"finished,omitempty"`
+
+	outcomes []taskOutcome
+	pass     float64
+	// done is closed when every task has run or been drained.
+	done chan struct{}
+}
+
+type taskOutcome struct {
+	at     time.Time
+	failed bool
+}
+
+var (
+	jobs   = make(map[int64]*Job)
+	jobsMu sync.Mutex
+)
+
+func (o JobOptions) validate() error {
+	switch {
+	case o.MaxFailures < 0:
+		return fmt.Errorf("maxFailures must not be negative")
+	case o.MaxErrorRate < 0 || o.MaxErrorRate > 1:
+		return fmt.Errorf("maxErrorRate must be between 0 and 1")
+	case o.ErrorRateWindowSeconds < 0 || o.MinSamples < 0 || o.DeadlineSeconds < 0 || o.Weight < 0 || o.MaxConcurrency < 0:
+		return fmt.Errorf("job options must not be negative")
+	}
+	return nil
+}
+
+func (o JobOptions) weight() int {
+	if o.Weight == 0 {
+		return 1
+	}
+	return o.Weight
+}
+
+// newJob registers a running job and queues its tasks, forgetting the
+// oldest finished jobs beyond the retention limit.
+func newJob(t Task, count int, options JobOptions) (*Job, error) {
+	id, err := nextSequenceIDs("jobs", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &Job{
+		ID:         id,
+		Task:       t,
+		Count:      count,
+		JobOptions: options,
+		State:      "running",
+		Queued:     count,
+		Created:    clock.Now(),
+		done:       make(chan struct{}),
+	}
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	jobs[j.ID] = j
+	var finished []int64
+	for id, other := range jobs {
+		if other.Finished != nil {
+			finished = append(finished, id)
+		}
+	}
+	if excess := len(finished) - *jobsRetention; excess > 0 {
+		sort.Slice(finished, func(a, b int) bool { return finished[a] < finished[b] })
+		for _, id := range finished[:excess] {
+			delete(jobs, id)
+		}
+	}
+
+	if count == 0 {
+		j.finish()
+	} else {
+		j.activate()
+	}
+	if j.DeadlineSeconds > 0 {
+		go j.enforceDeadline(time.Duration(j.DeadlineSeconds) * time.Second)
+	}
+	return j, nil
+}
+
+func (j *Job) enforceDeadline(deadline time.Duration) {
+	timer := clock.NewTimer(deadline)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C():
+		jobsMu.Lock()
+		j.abort(fmt.Sprintf("deadline of %s exceeded", deadline))
+		jobsMu.Unlock()
+	case <-j.done:
+	}
+}
+
+// abort drains the queued tasks of the job, letting running ones finish.
+// The caller must hold jobsMu.
+func (j *Job) abort(reason string) {
+	if j.State != "running" {
+		return
+	}
+	j.State = "aborted"
+	j.Reason = reason
+	fmt.Printf("Job aborted: %d: %s\n", j.ID, reason)
+
+	if j.Queued > 0 {
+		wg.Add(-j.Queued)
+		j.Drained += j.Queued
+		j.Queued = 0
+		j.deactivate()
+	}
+	j.finish()
+}
+
+// finish marks the job finished once every task is accounted for, if it
+// is not already. The caller must hold jobsMu.
+func (j *Job) finish() {
+	if j.Finished != nil || j.Succeeded+j.Failed+j.Drained < j.Count {
+		return
+	}
+	now := clock.Now()
+	j.Finished = &now
+	if j.State == "running" {
+		j.State = "completed"
+	}
+	close(j.done)
+}
+
+// taskFinished records the outcome of a task and aborts the job if that
+// crosses one of its thresholds.
+func (j *Job) taskFinished(err error) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	j.Running--
+	if j.MaxConcurrency > 0 {
+		jobsReady.Signal()
+	}
+	if err == nil {
+		j.Succeeded++
+	} else {
+		j.Failed++
+	}
+
+	if j.MaxFailures > 0 && j.Failed >= j.MaxFailures {
+		j.abort(fmt.Sprintf("%d tasks failed", j.Failed))
+	}
+	if j.MaxErrorRate > 0 {
+		j.checkErrorRate(err != nil)
+	}
+	j.finish()
+}
+
+// checkErrorRate adds an outcome to the window of recent outcomes and
+// aborts the job if too many of them are failures. The caller must hold
+// jobsMu.
+func (j *Job) checkErrorRate(failed bool) {
+	window := defaultErrorRateWindow
+	if j.ErrorRateWindowSeconds > 0 {
+		window = time.Duration(j.ErrorRateWindowSeconds) * time.Second
+	}
+	minSamples := defaultMinSamples
+	if j.MinSamples > 0 {
+		minSamples = j.MinSamples
+	}
+
+	now := clock.Now()
+	j.outcomes = append(j.outcomes, taskOutcome{at: now, failed: failed})
+	i := 0
+	for i < len(j.outcomes) && !j.outcomes[i].at.After(now.Add(-window)) {
+		i++
+	}
+	j.outcomes = j.outcomes[i:]
+
+	if len(j.outcomes) < minSamples {
+		return
+	}
+	failures := 0
+	for _, o := range j.outcomes {
+		if o.failed {
+			failures++
+		}
+	}
+	if rate := float64(failures) / float64(len(j.outcomes)); rate > j.MaxErrorRate {
+		j.abort(fmt.Sprintf("error rate %.2f over the last %s exceeded %.2f", rate, window, j.MaxErrorRate))
+	}
+}
+
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path[len("/jobs/"):], "/")
+	if path == "" {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleListJobs(w, r)
+		return
+	}
+
+	idPart, action := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		idPart, action = path[:i], path[i+1:]
+	}
+	id, err := strconv.ParseInt(idPart, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == "GET":
+	case action == "abort" && r.Method == "POST":
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The job is copied under the lock and encoded after releasing it, so a
+	// slow client does not hold up the workers.
+	jobsMu.Lock()
+	j, ok := jobs[id]
+	ok = ok && ownedBy(requestTenant(r), j.Task.Tenant)
+	running := ok && j.State == "running"
+	if running && action == "abort" {
+		j.abort("aborted by client")
+	}
+	var snapshot Job
+	if ok {
+		snapshot = *j
+	}
+	jobsMu.Unlock()
+
+	switch {
+	case !ok:
+		http.Error(w, "Job not found", http.StatusNotFound)
+	case action == "abort" && !running:
+		http.Error(w, "Job not running", http.StatusConflict)
+	default:
+		writeJSON(w, http.StatusOK, snapshot)
+	}
+}
+
+func handleListJobs(w http.ResponseWriter, r *http.Request) {
+	tenant := requestTenant(r)
+
+	jobsMu.Lock()
+	list := make([]Job, 0, len(jobs))
+	for _, j := range jobs {
+		if ownedBy(tenant, j.Task.Tenant) {
+			list = append(list, *j)
+		}
+	}
+	jobsMu.Unlock()
+
+	sort.Slice(list, func(a, b int) bool { return list[a].ID < list[b].ID })
+	writeJSON(w, http.StatusOK, list)
+}
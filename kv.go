@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The key/value store keeps string keys with a store-wide revision that
+// increases on every change, similar to etcd. Each key remembers the
+// revision it was created and last modified at, which clients use for
+// compare-and-swap and to resume watches.
+
+type KVEntry struct {
+	Key            string     `json:"key"`
+	Value          string     `json:"value"`
+	CreateRevision int64      `json:"createRevision"`
+	ModRevision    int64      `json:"modRevision"`
+	Version        int64      `json:"version"`
+	Expires        *time.Time `json:"expires,omitempty"`
+}
+
+type KVEvent struct {
+	Revision int64    `json:"revision"`
+	Type     string   `json:"type"`
+	Key      string   `json:"key"`
+	Entry    *KVEntry `json:"entry,omitempty"`
+}
+
+var kvHistory = flag.Int("kv-history", 10000, "number of key/value events kept for watches")
+
+const kvExpireInterval = time.Second
+
+var (
+	kvEntries  = make(map[string]*KVEntry)
+	kvRevision int64
+	kvEvents   []KVEvent
+	// kvTruncated is the highest revision whose event has been dropped.
+	kvTruncated int64
+	// kvNotify is closed and replaced whenever an event is recorded.
+	kvNotify = make(chan struct{})
+	kvMu     sync.Mutex
+)
+
+// recordKV advances the revision and logs the change for watchers. The
+// caller must hold kvMu.
+func recordKV(kind, key string, e *KVEntry) int64 {
+	kvRevision++
+	event := KVEvent{Revision: kvRevision, Type: kind, Key: key}
+	if e != nil {
+		entry := *e
+		entry.ModRevision = kvRevision
+		event.Entry = &entry
+	}
+
+	kvEvents = append(kvEvents, event)
+	if drop := len(kvEvents) - *kvHistory; drop > 0 {
+		kvTruncated = kvEvents[drop-1].Revision
+		kvEvents = kvEvents[drop:]
+	}
+	close(kvNotify)
+	kvNotify = make(chan struct{})
+	return kvRevision
+}
+
+// expireKV periodically deletes keys whose TTL ran out, so watchers see
+// the expiry as it happens.
+func expireKV() {
+	for {
+		clock.Sleep(kvExpireInterval)
+
+		kvMu.Lock()
+		now := clock.Now()
+		keys := make([]string, 0)
+		for key, e := range kvEntries {
+			if e.Expires != nil && !now.Before(*e.Expires) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			expireKey(key, now)
+		}
+		kvMu.Unlock()
+	}
+}
+
+// expireKey deletes the key if its TTL ran out by now. Requests call it
+// before looking at a key, so they never see an expired entry that
+// expireKV has not got to yet. The caller must hold kvMu.
+func expireKey(key string, now time.Time) {
+	if e, ok := kvEntries[key]; ok && e.Expires != nil && !now.Before(*e.Expires) {
+		delete(kvEntries, key)
+		recordKV("expire", key, nil)
+	}
+}
+
+func kvMatches(key, want string, prefix bool) bool {
+	if prefix {
+		return strings.HasPrefix(key, want)
+	}
+	return key == want
+}
+
+// kvEventsSince returns up to limit events after since for the key or
+// prefix, and the revision up to which events have been looked at. ok is
+// false if some of those events have been dropped.
+func kvEventsSince(key string, prefix bool, since int64, limit int) (events []KVEvent, through int64, notify chan struct{}, ok bool) {
+	kvMu.Lock()
+	defer kvMu.Unlock()
+
+	if since < kvTruncated {
+		return nil, since, nil, false
+	}
+	through = kvRevision
+	i := sort.Search(len(kvEvents), func(i int) bool { return kvEvents[i].Revision > since })
+	for ; i < len(kvEvents); i++ {
+		if !kvMatches(kvEvents[i].Key, key, prefix) {
+			continue
+		}
+		if len(events) == limit {
+			through = kvEvents[i].Revision - 1
+			break
+		}
+		events = append(events, kvEvents[i])
+	}
+	return events, through, kvNotify, true
+}
+
+func kvHandler(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/kv/")
+	query := r.URL.Query()
+	prefix := query.Get("prefix") != ""
+
+	if key == "" && !(prefix && r.Method == "GET") {
+		http.Error(w, "Missing key", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		if query.Get("watch") != "" {
+			handleWatchKV(w, r, key, prefix)
+		} else if prefix {
+			handleRangeKV(w, r, key)
+		} else {
+			handleGetKV(w, key)
+		}
+	case "PUT":
+		handlePutKV(w, r, key)
+	case "DELETE":
+		handleDeleteKV(w, r, key)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleGetKV(w http.ResponseWriter, key string) {
+	kvMu.Lock()
+	defer kvMu.Unlock()
+
+	expireKey(key, clock.Now())
+	e, ok := kvEntries[key]
+	if !ok {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("X-KV-Revision", strconv.FormatInt(kvRevision, 10))
+	writeJSON(w, http.StatusOK, e)
+}
+
+// handleRangeKV lists the keys starting with prefix in key order, starting
+// after the optional after key so large ranges can be paged through.
+func handleRangeKV(w http.ResponseWriter, r *http.Request, prefix string) {
+	query := r.URL.Query()
+
+	limit := 1000
+	if v := query.Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	after := query.Get("after")
+
+	kvMu.Lock()
+	defer kvMu.Unlock()
+
+	keys := make([]string, 0)
+	for key := range kvEntries {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	now := clock.Now()
+	live := keys[:0]
+	for _, key := range keys {
+		expireKey(key, now)
+		if _, ok := kvEntries[key]; ok {
+			live = append(live, key)
+		}
+	}
+	keys = live
+
+	var response struct {
+		Revision int64      `json:"revision"`
+		Entries  []*KVEntry `json:"entries"`
+		More     bool       `json:"more"`
+	}
+	response.Revision = kvRevision
+	if len(keys) > limit {
+		keys = keys[:limit]
+		response.More = true
+	}
+	response.Entries = make([]*KVEntry, 0, len(keys))
+	for _, key := range keys {
+		response.Entries = append(response.Entries, kvEntries[key])
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handlePutKV sets a key. With prevRevision set, the put only succeeds if
+// the key was last modified at that revision, or does not exist when it is
+// zero.
+func handlePutKV(w http.ResponseWriter, r *http.Request, key string) {
+	var request struct {
+		Value        string `json:"value"`
+		TTLSeconds   int    `json:"ttlSeconds"`
+		PrevRevision *int64 `json:"prevRevision"`
+	}
+	if !readJSONBody(w, r, &request) {
+		return
+	}
+
+	kvMu.Lock()
+	defer kvMu.Unlock()
+
+	expireKey(key, clock.Now())
+	e, ok := kvEntries[key]
+	if request.PrevRevision != nil {
+		var current int64
+		if ok {
+			current = e.ModRevision
+		}
+		if current != *request.PrevRevision {
+			writeKVConflict(w, e)
+			return
+		}
+	}
+
+	if !ok {
+		e = &KVEntry{Key: key, CreateRevision: kvRevision + 1}
+		kvEntries[key] = e
+	}
+	e.Value = request.Value
+	e.Version++
+	e.Expires = nil
+	if request.TTLSeconds > 0 {
+		expires := clock.Now().Add(time.Duration(request.TTLSeconds) * time.Second)
+		e.Expires = &expires
+	}
+	e.ModRevision = recordKV("put", key, e)
+	writeJSON(w, http.StatusOK, e)
+}
+
+// handleDeleteKV deletes a key, optionally only if it was last modified at
+// the prevRevision query parameter.
+func handleDeleteKV(w http.ResponseWriter, r *http.Request, key string) {
+	var prevRevision int64 = -1
+	if v := r.URL.Query().Get("prevRevision"); v != "" {
+		var err error
+		prevRevision, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid prevRevision parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	kvMu.Lock()
+	defer kvMu.Unlock()
+
+	expireKey(key, clock.Now())
+	e, ok := kvEntries[key]
+	if !ok {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return
+	}
+	if prevRevision >= 0 && e.ModRevision != prevRevision {
+		writeKVConflict(w, e)
+		return
+	}
+
+	delete(kvEntries, key)
+	recordKV("delete", key, nil)
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeKVConflict reports a failed compare-and-swap with the current entry,
+// if any.
+func writeKVConflict(w http.ResponseWriter, current *KVEntry) {
+	if current == nil {
+		http.Error(w, "Key not found", http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusConflict, current)
+}
+
+// handleWatchKV streams events for a key or prefix as newline-delimited
+// JSON until the client disconnects. Without a since revision only future
+// changes are sent.
+func handleWatchKV(w http.ResponseWriter, r *http.Request, key string, prefix bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var since int64
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		since, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || since < 0 {
+			http.Error(w, "Invalid since parameter", http.StatusBadRequest)
+			return
+		}
+	} else {
+		kvMu.Lock()
+		since = kvRevision
+		kvMu.Unlock()
+	}
+
+	if _, _, _, ok := kvEventsSince(key, prefix, since, 0); !ok {
+		http.Error(w, "Revision has been compacted", http.StatusGone)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		events, through, notify, ok := kvEventsSince(key, prefix, since, 1000)
+		if !ok {
+			enc.Encode(map[string]string{"error": "Revision has been compacted"})
+			return
+		}
+		for _, e := range events {
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+		}
+		since = through
+		flusher.Flush()
+
+		if len(events) > 0 {
+			continue
+		}
+		select {
+		case <-notify:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
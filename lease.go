@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lease is a time-limited hold on a coordination primitive such as a lock.
+// A lease is guarded by the mutex of the primitive owning it, which must be
+// held to renew or end it.
+type lease struct {
+	ID      string    `json:"leaseId"`
+	Holder  string    `json:"holder,omitempty"`
+	Expires time.Time `json:"expires"`
+	ended   bool
+	done    chan struct{}
+}
+
+func newLease(holder string, ttl time.Duration) *lease {
+	return &lease{
+		ID:      randomID(),
+		Holder:  holder,
+		Expires: clock.Now().Add(ttl),
+		done:    make(chan struct{}),
+	}
+}
+
+// renew extends the lease to ttl from now.
+func (l *lease) renew(ttl time.Duration) {
+	l.Expires = clock.Now().Add(ttl)
+}
+
+// end releases the lease and stops watching it.
+func (l *lease) end() {
+	if !l.ended {
+		l.ended = true
+		close(l.done)
+	}
+}
+
+// watch ends the lease once it runs out without being renewed, calling
+// onExpire with mu held. The caller must hold mu; the watching happens in
+// the background until the lease ends.
+func (l *lease) watch(mu *sync.Mutex, onExpire func()) {
+	wait := l.Expires.Sub(clock.Now())
+
+	go func() {
+		for {
+			timer := clock.NewTimer(wait)
+			select {
+			case <-timer.C():
+			case <-l.done:
+				timer.Stop()
+				return
+			}
+
+			mu.Lock()
+			if l.ended {
+				mu.Unlock()
+				return
+			}
+			// The lease may have been renewed while the timer ran.
+			wait = l.Expires.Sub(clock.Now())
+			if wait > 0 {
+				mu.Unlock()
+				continue
+			}
+			l.end()
+			onExpire()
+			mu.Unlock()
+			return
+		}
+	}()
+}
+
+// readJSONBody decodes an optional JSON request body into v, writing an
+// error response if it cannot.
+func readJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		return false
+	}
+	if len(body) == 0 {
+		return true
+	}
+
+	if err := json.Unmarshal(body, v); err != nil {
+		http.Error(w, "Error parsing request body", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func seconds(n int, def time.Duration) time.Duration {
+	if n <= 0 {
+		return def
+	}
+	return time.Duration(n) * time.Second
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// splitAction splits "/prefix/{name}/{action}" into name and action. The
+// action is empty when the path names a resource only.
+func splitAction(path, prefix string, actions ...string) (name, action string) {
+	name = strings.Trim(path[len(prefix):], "/")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		for _, a := range actions {
+			if name[i+1:] == a {
+				return name[:i], a
+			}
+		}
+	}
+	return name, ""
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rate limiters let clients share limits through the server. Each limiter
+// allows limit units per period using one of three algorithms:
+//
+//   - token_bucket refills continuously and allows bursts up to burst.
+//   - fixed_window counts units in consecutive windows of one period.
+//   - sliding_log remembers every take within the last period along with
+//     the number of units taken.
+
+type LimiterDefinition struct {
+	Algorithm string `json:"algorithm"`
+	Limit     int    `json:"limit"`
+	Period    string `json:"period"`
+	// Burst is the bucket size of a token bucket, by default Limit.
+	Burst int `json:"burst,omitempty"`
+}
+
+type LimiterState struct {
+	Name string `json:"name"`
+	LimiterDefinition
+	Available int `json:"available"`
+}
+
+type TakeResult struct {
+	Allowed   bool `json:"allowed"`
+	Remaining int  `json:"remaining"`
+	// RetryAfter is how many seconds to wait before the units could be
+	// taken, when they were not.
+	RetryAfter float64 `json:"retryAfter,omitempty"`
+}
+
+type limiter struct {
+	name   string
+	def    LimiterDefinition
+	period time.Duration
+
+	// token_bucket
+	tokens float64
+	filled time.Time
+	// fixed_window
+	windowStart time.Time
+	windowCount int
+	// sliding_log: the takes within the last period and their total units
+	log    []loggedTake
+	logged int
+}
+
+// loggedTake records n units taken at once by a sliding log limiter.
+type loggedTake struct {
+	at time.Time
+	n  int
+}
+
+var (
+	limiters   = make(map[string]*limiter)
+	limitersMu sync.Mutex
+)
+
+func newLimiter(name string, def LimiterDefinition) (*limiter, error) {
+	period, err := time.ParseDuration(def.Period)
+	if err != nil || period <= 0 {
+		return nil, fmt.Errorf("invalid period %q", def.Period)
+	}
+	if def.Limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive")
+	}
+
+	l := &limiter{name: name, def: def, period: period}
+	switch def.Algorithm {
+	case "token_bucket":
+		if l.def.Burst <= 0 {
+			l.def.Burst = def.Limit
+		}
+		l.tokens = float64(l.def.Burst)
+		l.filled = clock.Now()
+	case "fixed_window", "sliding_log":
+		l.def.Burst = 0
+	default:
+		return nil, fmt.Errorf("unknown algorithm %q", def.Algorithm)
+	}
+	return l, nil
+}
+
+// capacity is the most units that can ever be taken at once.
+func (l *limiter) capacity() int {
+	if l.def.Algorithm == "token_bucket" {
+		return l.def.Burst
+	}
+	return l.def.Limit
+}
+
+// available brings the limiter up to date and returns the units that can
+// be taken now. The caller must hold limitersMu.
+func (l *limiter) available(now time.Time) int {
+	switch l.def.Algorithm {
+	case "token_bucket":
+		rate := float64(l.def.Limit) / l.period.Seconds()
+		l.tokens = math.Min(float64(l.def.Burst), l.tokens+now.Sub(l.filled).Seconds()*rate)
+		l.filled = now
+		return int(l.tokens)
+	case "fixed_window":
+		if start := now.Truncate(l.period); !start.Equal(l.windowStart) {
+			l.windowStart = start
+			l.windowCount = 0
+		}
+		return l.def.Limit - l.windowCount
+	default:
+		i := 0
+		for i < len(l.log) && !l.log[i].at.After(now.Add(-l.period)) {
+			l.logged -= l.log[i].n
+			i++
+		}
+		l.log = l.log[i:]
+		return l.def.Limit - l.logged
+	}
+}
+
+// take takes n units if they are available, or else reports how long it
+// will be until they are. The caller must hold limitersMu.
+func (l *limiter) take(n int) (TakeResult, time.Duration) {
+	now := clock.Now()
+	available := l.available(now)
+	if n <= available {
+		switch l.def.Algorithm {
+		case "token_bucket":
+			l.tokens -= float64(n)
+		case "fixed_window":
+			l.windowCount += n
+		default:
+			l.log = append(l.log, loggedTake{at: now, n: n})
+			l.logged += n
+		}
+		return TakeResult{Allowed: true, Remaining: available - n}, 0
+	}
+
+	var retry time.Duration
+	switch l.def.Algorithm {
+	case "token_bucket":
+		rate := float64(l.def.Limit) / l.period.Seconds()
+		retry = time.Duration(math.Ceil((float64(n) - l.tokens) / rate * float64(time.Second)))
+	case "fixed_window":
+		retry = l.windowStart.Add(l.period).Sub(now)
+	default:
+		// Enough units are free once the oldest excess ones leave the log.
+		freed := available
+		for _, e := range l.log {
+			freed += e.n
+			if freed >= n {
+				retry = e.at.Add(l.period).Sub(now)
+				break
+			}
+		}
+	}
+	return TakeResult{Remaining: available, RetryAfter: retry.Seconds()}, retry
+}
+
+func (l *limiter) state() LimiterState {
+	return LimiterState{Name: l.name, LimiterDefinition: l.def, Available: l.available(clock.Now())}
+}
+
+func limiterHandler(w http.ResponseWriter, r *http.Request) {
+	name, action := splitAction(r.URL.Path, "/limiters/", "take")
+	if name == "" && r.Method == "GET" {
+		handleListLimiters(w, r)
+		return
+	}
+	if name == "" {
+		http.Error(w, "Missing limiter name", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == "GET":
+		limitersMu.Lock()
+		l, ok := limiters[name]
+		var s LimiterState
+		if ok {
+			s = l.state()
+		}
+		limitersMu.Unlock()
+		if !ok {
+			http.Error(w, "Limiter not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	case action == "" && r.Method == "PUT":
+		handlePutLimiter(w, r, name)
+	case action == "" && r.Method == "DELETE":
+		limitersMu.Lock()
+		delete(limiters, name)
+		limitersMu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	case action == "take" && r.Method == "POST":
+		handleTake(w, r, name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleListLimiters(w http.ResponseWriter, r *http.Request) {
+	tenant := requestTenant(r)
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+
+	list := make([]LimiterState, 0, len(limiters))
+	for name, l := range limiters {
+		if inTenant(tenant, name) {
+			list = append(list, l.state())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handlePutLimiter defines a limiter. Redefining a limiter starts it
+// afresh.
+func handlePutLimiter(w http.ResponseWriter, r *http.Request, name string) {
+	var def LimiterDefinition
+	if !readJSONBody(w, r, &def) {
+		return
+	}
+	l, err := newLimiter(name, def)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+
+	limiters[name] = l
+	writeJSON(w, http.StatusOK, l.state())
+}
+
+// handleTake takes n units from the limiter. When they are not available
+// and would be within waitSeconds, it waits for them; otherwise it answers
+// 429 with the time to retry after.
+func handleTake(w http.ResponseWriter, r *http.Request, name string) {
+	var request struct {
+		N           int     `json:"n"`
+		WaitSeconds float64 `json:"waitSeconds"`
+	}
+	if !readJSONBody(w, r, &request) {
+		return
+	}
+	if request.N <= 0 {
+		request.N = 1
+	}
+	deadline := clock.Now().Add(time.Duration(request.WaitSeconds * float64(time.Second)))
+
+	for {
+		limitersMu.Lock()
+		l, ok := limiters[name]
+		if !ok {
+			limitersMu.Unlock()
+			http.Error(w, "Limiter not found", http.StatusNotFound)
+			return
+		}
+		if request.N > l.capacity() {
+			limitersMu.Unlock()
+			http.Error(w, "Units exceed limiter capacity", http.StatusBadRequest)
+			return
+		}
+		result, retry := l.take(request.N)
+		limitersMu.Unlock()
+
+		if result.Allowed {
+			writeJSON(w, http.StatusOK, result)
+			return
+		}
+		if clock.Now().Add(retry).After(deadline) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+			writeJSON(w, http.StatusTooManyRequests, result)
+			return
+		}
+
+		// Other clients may take the units first, in which case we retry
+		// until the deadline.
+		timer := clock.NewTimer(retry)
+		select {
+		case <-timer.C():
+		case <-r.Context().Done():
+			timer.Stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A distributedLock is held by at most one lease at a time. Waiters are
+// granted the lock in arrival order when it is released or its lease
+// expires.
+type distributedLock struct {
+	name         string
+	lease        *lease
+	fencingToken int64
+	waiters      []*lockWaiter
+}
+
+type lockWaiter struct {
+	holder  string
+	ttl     time.Duration
+	granted chan LockState
+}
+
+type LockState struct {
+	Name         string     `json:"name"`
+	Holder       string     `json:"holder,omitempty"`
+	LeaseID      string     `json:"leaseId,omitempty"`
+	FencingToken int64      `json:"fencingToken,omitempty"`
+	Expires      *time.Time `json:"expires,omitempty"`
+	Waiters      int        `json:"waiters"`
+}
+
+// Fencing tokens come from one counter shared by all locks, so they keep
+// increasing even when an idle lock is forgotten and later recreated.
+var (
+	locks          = make(map[string]*distributedLock)
+	fencingCounter int64
+	locksMu        sync.Mutex
+)
+
+const defaultLeaseTTL = 30 * time.Second
+
+// state describes the lock. The lease ID is only included for the caller
+// that acquired it. The caller must hold locksMu.
+func (l *distributedLock) state(withLease bool) LockState {
+	s := LockState{Name: l.name, Waiters: len(l.waiters)}
+	if l.lease != nil {
+		expires := l.lease.Expires
+		s.Holder = l.lease.Holder
+		s.FencingToken = l.fencingToken
+		s.Expires = &expires
+		if withLease {
+			s.LeaseID = l.lease.ID
+		}
+	}
+	return s
+}
+
+// grant gives the lock to a new lease with the next fencing token. The
+// caller must hold locksMu.
+func (l *distributedLock) grant(holder string, ttl time.Duration) LockState {
+	fencingCounter++
+	l.fencingToken = fencingCounter
+	l.lease = newLease(holder, ttl)
+	l.lease.watch(&locksMu, func() {
+		fmt.Printf("Lock lease expired: %s\n", l.name)
+		l.release()
+	})
+	return l.state(true)
+}
+
+// release ends the current lease and hands the lock to the next waiter,
+// forgetting the lock once nobody holds or waits for it. The caller must
+// hold locksMu.
+func (l *distributedLock) release() {
+	if l.lease != nil {
+		l.lease.end()
+		l.lease = nil
+	}
+
+	if len(l.waiters) > 0 {
+		w := l.waiters[0]
+		l.waiters = l.waiters[1:]
+		w.granted <- l.grant(w.holder, w.ttl)
+		return
+	}
+	delete(locks, l.name)
+}
+
+func (l *distributedLock) removeWaiter(w *lockWaiter) bool {
+	for i, other := range l.waiters {
+		if other == w {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func lockHandler(w http.ResponseWriter, r *http.Request) {
+	name, action := splitAction(r.URL.Path, "/locks/", "acquire", "renew", "release")
+
+	switch {
+	case action == "" && r.Method == "GET":
+		handleGetLock(w, r, name)
+	case action != "" && r.Method == "POST":
+		if name == "" {
+			http.Error(w, "Missing lock name", http.StatusBadRequest)
+			return
+		}
+		switch action {
+		case "acquire":
+			handleAcquireLock(w, r, name)
+		case "renew":
+			handleRenewLock(w, r, name)
+		case "release":
+			handleReleaseLock(w, r, name)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleGetLock(w http.ResponseWriter, r *http.Request, name string) {
+	tenant := requestTenant(r)
+	locksMu.Lock()
+	defer locksMu.Unlock()
+
+	if name == "" {
+		list := make([]LockState, 0, len(locks))
+		for name, l := range locks {
+			if inTenant(tenant, name) {
+				list = append(list, l.state(false))
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+		writeJSON(w, http.StatusOK, list)
+		return
+	}
+
+	l, ok := locks[name]
+	if !ok {
+		writeJSON(w, http.StatusOK, LockState{Name: name})
+		return
+	}
+	writeJSON(w, http.StatusOK, l.state(false))
+}
+
+// handleAcquireLock takes the lock if it is free. Otherwise it fails at
+// once, or waits up to waitSeconds for the lock to be handed over.
+func handleAcquireLock(w http.ResponseWriter, r *http.Request, name string) {
+	var request struct {
+		Holder      string `json:"holder"`
+		TTLSeconds  int    `json:"ttlSeconds"`
+		WaitSeconds int    `json:"waitSeconds"`
+	}
+	if !readJSONBody(w, r, &request) {
+		return
+	}
+	ttl := seconds(request.TTLSeconds, defaultLeaseTTL)
+
+	locksMu.Lock()
+	l, ok := locks[name]
+	if !ok {
+		l = &distributedLock{name: name}
+		locks[name] = l
+	}
+	if l.lease == nil && len(l.waiters) == 0 {
+		s := l.grant(request.Holder, ttl)
+		locksMu.Unlock()
+		writeJSON(w, http.StatusOK, s)
+		return
+	}
+	if request.WaitSeconds <= 0 {
+		s := l.state(false)
+		locksMu.Unlock()
+		writeJSON(w, http.StatusConflict, s)
+		return
+	}
+
+	waiter := &lockWaiter{holder: request.Holder, ttl: ttl, granted: make(chan LockState, 1)}
+	l.waiters = append(l.waiters, waiter)
+	locksMu.Unlock()
+
+	timer := clock.NewTimer(time.Duration(request.WaitSeconds) * time.Second)
+	defer timer.Stop()
+
+	select {
+	case s := <-waiter.granted:
+		writeJSON(w, http.StatusOK, s)
+		return
+	case <-timer.C():
+	case <-r.Context().Done():
+	}
+
+	locksMu.Lock()
+	defer locksMu.Unlock()
+
+	if l.removeWaiter(waiter) {
+		if l.lease == nil && len(l.waiters) == 0 {
+			delete(locks, name)
+		}
+		writeJSON(w, http.StatusConflict, l.state(false))
+		return
+	}
+
+	// The lock was granted while we gave up waiting. Its lease may have
+	// expired meanwhile and passed the lock on, so it is only released if
+	// still ours.
+	s := <-waiter.granted
+	if r.Context().Err() != nil {
+		if l.lease != nil && l.lease.ID == s.LeaseID {
+			l.release()
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+func handleRenewLock(w http.ResponseWriter, r *http.Request, name string) {
+	var request struct {
+		LeaseID    string `json:"leaseId"`
+		TTLSeconds int    `json:"ttlSeconds"`
+	}
+	if !readJSONBody(w, r, &request) {
+		return
+	}
+
+	locksMu.Lock()
+	defer locksMu.Unlock()
+
+	l, ok := locks[name]
+	if !ok || l.lease == nil || l.lease.ID != request.LeaseID {
+		http.Error(w, "Lease not held", http.StatusConflict)
+		return
+	}
+
+	l.lease.renew(seconds(request.TTLSeconds, defaultLeaseTTL))
+	writeJSON(w, http.StatusOK, l.state(true))
+}
+
+func handleReleaseLock(w http.ResponseWriter, r *http.Request, name string) {
+	var request struct {
+		LeaseID string `json:"leaseId"`
+	}
+	if !readJSONBody(w, r, &request) {
+		return
+	}
+
+	locksMu.Lock()
+	defer locksMu.Unlock()
+
+	l, ok := locks[name]
+	if !ok || l.lease == nil || l.lease.ID != request.LeaseID {
+		http.Error(w, "Lease not held", http.StatusConflict)
+		return
+	}
+
+	l.release()
+	w.WriteHeader(http.StatusOK)
+}
@@ -2,53 +2,140 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 type Message struct {
-	ID      int    `json:"id"`
-	Message string `json:"message"`
-	Task    Task   `json:"task"`
+	ID          int               `json:"id"`
+	Message     string            `json:"message"`
+	ContentType string            `json:"contentType,omitempty"`
+	Payload     json.RawMessage   `json:"payload,omitempty"`
+	Data        []byte            `json:"data,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	GroupKey    string            `json:"groupKey,omitempty"`
+	// Tenant is the tenant of the caller that created the message, who is
+	// the only one to see it besides unconfined callers.
+	Tenant string `json:"tenant,omitempty"`
+	// DelaySeconds and DeliverAt hide a message until it is due.
+	DelaySeconds int        `json:"delaySeconds,omitempty"`
+	DeliverAt    *time.Time `json:"deliverAt,omitempty"`
+	Task         Task       `json:"task"`
 }
 
 type Task struct {
-	ID            int    `json:"id"`
-	Task          string `json:"task"`
-	URL           string `json:"url"`
-	SleepDuration int    `json:"sleepDuration"`
+	ID            int            `json:"id"`
+	Task          string         `json:"task"`
+	URL           string         `json:"url"`
+	SleepDuration int            `json:"sleepDuration"`
+	Script        string         `json:"script,omitempty"`
+	Steps         []ScenarioStep `json:"steps,omitempty"`
+	// Credentials names the credential profile authenticating requests.
+	Credentials string `json:"credentials,omitempty"`
+	// Tenant is the tenant of the caller that ran the task. Messages and
+	// results of the task belong to it.
+	Tenant string `json:"-"`
 }
 
 var (
 	messages     = make(map[int]Message)
-	nextID       = 1
 	messagesMu   sync.Mutex
-	taskQueue    = make(chan Task, 1000)
 	counterChan  = make(chan int)
+	failureChan  = make(chan int)
 	wg           sync.WaitGroup
 	taskCounter  int
+	failures     int
 	counterMutex sync.Mutex
 )
 
+var (
+	maxMessageSize = flag.Int64("max-message-size", 1<<20, "maximum size in bytes of a message body or upload")
+	maxAttributes  = flag.Int("max-attributes", 32, "maximum number of attributes per message")
+)
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "target" {
+		runTarget(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "script" {
+		runScriptProcess(os.Args[2:])
+		return
+	}
+
+	flag.Parse()
+
+	if err := checkSchedulingPolicy(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkCORSConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadChaosConfig(); err != nil {
+		log.Fatalf("Error loading chaos config: %v", err)
+	}
+	if err := loadSecrets(); err != nil {
+		log.Fatalf("Error loading secrets: %v", err)
+	}
+	if err := loadIDs(); err != nil {
+		log.Fatalf("Error loading IDs: %v", err)
+	}
+	if err := loadJWKS(); err != nil {
+		log.Fatalf("Error loading JWKS: %v", err)
+	}
+	if err := loadCredentials(); err != nil {
+		log.Fatalf("Error loading credentials: %v", err)
+	}
+	if err := startPlugins(); err != nil {
+		log.Fatalf("Error starting plugins: %v", err)
+	}
+
 	http.HandleFunc("/run/", runHandler)
+	http.HandleFunc("/jobs/", jobsHandler)
 	http.HandleFunc("/wait/", waitHandler)
+	http.HandleFunc("/waitgroups/", waitGroupHandler)
+	http.HandleFunc("/barriers/", barrierHandler)
 	http.HandleFunc("/messages/", messageHandler)
+	http.HandleFunc("/kv/", kvHandler)
+	http.HandleFunc("/ids/", idsHandler)
 	http.HandleFunc("/count/", countHandler)
+	http.HandleFunc("/counters/", counterHandler)
+	http.HandleFunc("/rates/", rateHandler)
+	http.HandleFunc("/limiters/", limiterHandler)
+	http.HandleFunc("/semaphores/", semaphoreHandler)
+	http.HandleFunc("/results/", resultsHandler)
+	http.HandleFunc("/locks/", lockHandler)
+	http.HandleFunc("/elections/", electionHandler)
+	http.HandleFunc("/credentials/", credentialsHandler)
+	http.HandleFunc("/secrets/", secretsHandler)
+	http.HandleFunc("/admin/chaos", chaosHandler)
+	http.HandleFunc("/admin/plugins", pluginsHandler)
+
+	rebuildIndex()
 
 	go counter()
+	go changeCompactor()
+	go scheduler()
+	go collectIdleCoordination()
+	go expireCounters()
+	go expireKV()
 
 	for i := 0; i < 10000; i++ {
 		go worker()
 	}
 
 	fmt.Println("Server is running on port 8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	log.Fatal(http.ListenAndServe(":8080", corsMiddleware(authMiddleware(http.DefaultServeMux))))
 }
 
 func waitHandler(w http.ResponseWriter, r *http.Request) {
@@ -60,56 +147,147 @@ func waitHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func worker() {
-	for task := range taskQueue {
-		fmt.Println("Task received: ", task.ID)
-		wg.Add(1)
+	for {
+		slowDequeue()
+
+		job := nextJobTask()
+		t := job.Task
+		fmt.Println("Task received: ", t.ID)
 
-		go func(t Task) {
-			defer wg.Done()
-			processTask(t)
+		err := runTask(t)
+		if err != nil {
+			fmt.Printf("Task failed: %d: %s\n", t.ID, redact(err.Error()))
+			failureChan <- 1
+		}
+		job.taskFinished(err)
 
+		if !dropAck() {
 			counterChan <- 1
-		}(task)
+		}
+		wg.Done()
 	}
 }
 
-func processTask(t Task) {
-	if t.URL != "" {
-		resp, err := http.Get(t.URL)
-		if err != nil {
-			fmt.Printf("Error fetching URL %s: %v\n", t.URL, err)
-		} else {
-			fmt.Printf("Fetched URL %s: %s\n", t.URL, resp.Status)
-			resp.Body.Close()
+// runTask processes a task with fault injection, turning a panic into a
+// task failure so it cannot crash the process.
+func runTask(t Task) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
 		}
+	}()
+
+	if err := injectFault(); err != nil {
+		return err
+	}
+	return processTask(t)
+}
+
+// taskHandlers maps a lower-cased task type to the function running it.
+// Tasks without a type are fetch tasks.
+var (
+	taskHandlers = map[string]func(Task) error{
+		"":         fetchTask,
+		"fetch":    fetchTask,
+		"script":   scriptTask,
+		"scenario": scenarioTask,
+	}
+	taskHandlersMu sync.Mutex
+)
+
+func registerTaskHandler(taskType string, handler func(Task) error) {
+	taskHandlersMu.Lock()
+	defer taskHandlersMu.Unlock()
+	taskHandlers[strings.ToLower(taskType)] = handler
+}
+
+func unregisterTaskHandler(taskType string) {
+	taskHandlersMu.Lock()
+	defer taskHandlersMu.Unlock()
+	delete(taskHandlers, strings.ToLower(taskType))
+}
+
+func lookupTaskHandler(taskType string) (func(Task) error, bool) {
+	taskHandlersMu.Lock()
+	defer taskHandlersMu.Unlock()
+	handler, ok := taskHandlers[strings.ToLower(taskType)]
+	return handler, ok
+}
+
+func processTask(t Task) error {
+	handler, ok := lookupTaskHandler(t.Task)
+	if !ok {
+		return fmt.Errorf("unknown task type %q", t.Task)
+	}
+
+	if err := handler(t); err != nil {
+		return err
+	}
+
+	fmt.Printf("Task completed: %d\n", t.ID)
+	return nil
+}
+
+// fetchTask fetches the task's URL, if any, and then sleeps for its sleep
+// duration. The sleep happens even when the fetch fails, so failing tasks
+// take as long as succeeding ones.
+func fetchTask(t Task) error {
+	var err error
+	if t.URL != "" {
+		err = fetchURL(t)
 	}
 
 	if t.SleepDuration > 0 {
 		fmt.Printf("Sleeping for %d seconds\n", t.SleepDuration)
-		time.Sleep(time.Duration(t.SleepDuration) * time.Second)
+		clock.Sleep(time.Duration(t.SleepDuration) * time.Second)
 	}
+	return err
+}
 
-	fmt.Printf("Task completed: %d\n", t.ID)
+// fetchURL fetches the task's URL. Error statuses count as failures, so
+// job failure thresholds see the target failing.
+func fetchURL(t Task) error {
+	url, err := resolveSecrets(t.URL)
+	if err != nil {
+		return fmt.Errorf("fetching URL %s: %v", t.URL, err)
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("fetching URL %s: %v", t.URL, err)
+	}
+	resp, err := doWithCredentials(http.DefaultClient, req, t.Credentials)
+	if err != nil {
+		return fmt.Errorf("fetching URL %s: %v", t.URL, err)
+	}
+	fmt.Printf("Fetched URL %s: %s\n", t.URL, resp.Status)
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("fetching URL %s: %s", t.URL, resp.Status)
+	}
+	return nil
 }
 
 func counter() {
-	for increment := range counterChan {
-		taskCounter += increment
+	for {
+		select {
+		case increment := <-counterChan:
+			counterMutex.Lock()
+			taskCounter += increment
+			counterMutex.Unlock()
+		case increment := <-failureChan:
+			counterMutex.Lock()
+			failures += increment
+			counterMutex.Unlock()
+		}
 	}
 }
 
-func incrementCounter() {
+func countHandler(w http.ResponseWriter, r *http.Request) {
 	counterMutex.Lock()
 	defer counterMutex.Unlock()
 
-	taskCounter++
-
-	fmt.Printf("Task counter incremented: %d\n", taskCounter)
-}
-
-func countHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]int{"taskCounter": taskCounter})
+	json.NewEncoder(w).Encode(map[string]int{"taskCounter": taskCounter, "failures": failures})
 }
 
 func runHandler(w http.ResponseWriter, r *http.Request) {
@@ -125,6 +303,7 @@ func handleRun(w http.ResponseWriter, r *http.Request) {
 	var request struct {
 		Task  Task `json:"task"`
 		Count int  `json:"count"`
+		JobOptions
 	}
 
 	body, err := io.ReadAll(r.Body)
@@ -138,24 +317,80 @@ func handleRun(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	messagesMu.Lock()
-	defer messagesMu.Unlock()
+	request.Task.Tenant = requestTenant(r)
+	if _, ok := lookupTaskHandler(request.Task.Task); !ok {
+		http.Error(w, "Unknown task type", http.StatusBadRequest)
+		return
+	}
+	if request.Count < 0 {
+		http.Error(w, "Count must not be negative", http.StatusBadRequest)
+		return
+	}
+	if err := request.JobOptions.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	for i := 0; i < request.Count; i++ {
-		taskQueue <- request.Task
+	wg.Add(request.Count)
+	job, err := newJob(request.Task, request.Count, request.JobOptions)
+	if err != nil {
+		wg.Add(-request.Count)
+		fmt.Printf("Error creating job: %v\n", err)
+		http.Error(w, "Error creating job", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
-	json.NewEncoder(w).Encode(map[string]string{"status": "tasks queued"})
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "tasks queued", "jobId": job.ID})
 }
 
 func messageHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/messages/search":
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleSearchMessages(w, r)
+		return
+	case "/messages/changes":
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleChanges(w, r)
+		return
+	case "/messages/receive":
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleReceive(w, r)
+		return
+	case "/messages/ack":
+		if r.Method != "POST" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleAck(w, r)
+		return
+	case "/messages/scheduled":
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleScheduledMessages(w, r)
+		return
+	}
+
 	switch r.Method {
 	case "GET":
 		handleGetMessage(w, r)
 	case "POST":
 		handlePostMessage(w, r)
+	case "PUT":
+		handlePutMessage(w, r)
 	case "DELETE":
 		handleDeleteMessage(w, r)
 	default:
@@ -164,6 +399,11 @@ func messageHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleGetMessage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/messages/" {
+		handleListMessages(w, r)
+		return
+	}
+
 	id, err := strconv.Atoi(r.URL.Path[len("/messages/"):])
 	if err != nil {
 		http.Error(w, "Invalid message ID", http.StatusBadRequest)
@@ -174,7 +414,7 @@ func handleGetMessage(w http.ResponseWriter, r *http.Request) {
 	defer messagesMu.Unlock()
 
 	p, ok := messages[id]
-	if !ok {
+	if !ok || isScheduled(id) || !ownedBy(requestTenant(r), p.Tenant) {
 		http.Error(w, "Message not found", http.StatusNotFound)
 		return
 	}
@@ -183,32 +423,268 @@ func handleGetMessage(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(p)
 }
 
-func handlePostMessage(w http.ResponseWriter, r *http.Request) {
-	var m Message
+func handleListMessages(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	contentType := query.Get("contentType")
+	attrs := make(map[string]string)
+	for key, values := range query {
+		if strings.HasPrefix(key, "attr.") {
+			attrs[key[len("attr."):]] = values[0]
+		}
+	}
 
-	body, err := io.ReadAll(r.Body)
+	tenant := requestTenant(r)
+
+	messagesMu.Lock()
+	list := make([]Message, 0, len(messages))
+	for _, m := range messages {
+		if !ownedBy(tenant, m.Tenant) {
+			continue
+		}
+		if contentType != "" && m.ContentType != contentType {
+			continue
+		}
+		if !matchAttributes(m, attrs) || isScheduled(m.ID) {
+			continue
+		}
+		list = append(list, m)
+	}
+	messagesMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func matchAttributes(m Message, attrs map[string]string) bool {
+	for key, value := range attrs {
+		if v, ok := m.Attributes[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+func handlePostMessage(w http.ResponseWriter, r *http.Request) {
+	m, err := readMessage(w, r)
 	if err != nil {
-		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		writeMessageError(w, err)
 		return
 	}
+	m.Tenant = requestTenant(r)
 
-	if err := json.Unmarshal(body, &m); err != nil {
-		http.Error(w, "Error parsing request body", http.StatusBadRequest)
+	m, err = createMessage(m)
+	if err != nil {
+		fmt.Printf("Error creating message: %v\n", err)
+		http.Error(w, "Error creating message", http.StatusInternalServerError)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(m)
+}
+
+// createMessage assigns the message an ID from the messages sequence and
+// adds it to the store. The create event of a delayed message is recorded
+// by the scheduler once it is delivered.
+func createMessage(m Message) (Message, error) {
 	messagesMu.Lock()
 	defer messagesMu.Unlock()
 
-	m.ID = nextID
-	nextID++
+	id, err := nextSequenceIDs(messageSequence, 1)
+	if err != nil {
+		return m, err
+	}
+	m.ID = int(id)
 	messages[m.ID] = m
+	scheduleMessage(m)
+	searchIndex.add(m)
+	if !isScheduled(m.ID) {
+		recordChange("create", m)
+	}
+	return m, nil
+}
+
+func handlePutMessage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Path[len("/messages/"):])
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	m, err := readMessage(w, r)
+	if err != nil {
+		writeMessageError(w, err)
+		return
+	}
+
+	messagesMu.Lock()
+	defer messagesMu.Unlock()
+
+	old, ok := messages[id]
+	if !ok || !ownedBy(requestTenant(r), old.Tenant) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	m.ID = id
+	m.Tenant = old.Tenant
+	wasScheduled := isScheduled(id)
+	searchIndex.remove(old)
+	messages[id] = m
+	scheduleMessage(m)
+	searchIndex.add(m)
+	// Hidden messages do not show up in the change feed until delivered, so
+	// a visible message that is hidden again disappears from it.
+	switch {
+	case isScheduled(id) && !wasScheduled:
+		recordChange("delete", m)
+	case isScheduled(id):
+	case wasScheduled:
+		recordChange("create", m)
+	default:
+		recordChange("update", m)
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(m)
 }
 
+var (
+	errMessageTooLarge = errors.New("Message too large")
+	errReadBody        = errors.New("Error reading request body")
+	errParseBody       = errors.New("Error parsing request body")
+)
+
+func writeMessageError(w http.ResponseWriter, err error) {
+	switch err {
+	case errMessageTooLarge:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errReadBody:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// readMessage reads and validates a message from either a JSON body or a
+// multipart upload.
+func readMessage(w http.ResponseWriter, r *http.Request) (Message, error) {
+	var m Message
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		m, err = readMultipartMessage(w, r)
+	} else {
+		m, err = readJSONMessage(r)
+	}
+	if err != nil {
+		return m, err
+	}
+
+	err = validateMessage(&m)
+	return m, err
+}
+
+func readJSONMessage(r *http.Request) (Message, error) {
+	var m Message
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, *maxMessageSize+1))
+	if err != nil {
+		return m, errReadBody
+	}
+	if int64(len(body)) > *maxMessageSize {
+		return m, errMessageTooLarge
+	}
+
+	if err := json.Unmarshal(body, &m); err != nil {
+		return m, errParseBody
+	}
+	return m, nil
+}
+
+// readMultipartMessage builds a message from a multipart upload. The "file"
+// part becomes the binary payload, "message" and "contentType" fields map to
+// the message fields and "attr.<name>" fields become attributes.
+func readMultipartMessage(w http.ResponseWriter, r *http.Request) (Message, error) {
+	var m Message
+
+	// Leave some room for the multipart framing around the payload.
+	r.Body = http.MaxBytesReader(w, r.Body, *maxMessageSize+64<<10)
+	if err := r.ParseMultipartForm(*maxMessageSize); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return m, errMessageTooLarge
+		}
+		return m, errParseBody
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	m.Message = r.FormValue("message")
+	m.ContentType = r.FormValue("contentType")
+	for key, values := range r.MultipartForm.Value {
+		if strings.HasPrefix(key, "attr.") {
+			if m.Attributes == nil {
+				m.Attributes = make(map[string]string)
+			}
+			m.Attributes[key[len("attr."):]] = values[0]
+		}
+	}
+
+	file, header, err := r.FormFile("file")
+	if err == http.ErrMissingFile {
+		return m, nil
+	}
+	if err != nil {
+		return m, errParseBody
+	}
+	defer file.Close()
+
+	if header.Size > *maxMessageSize {
+		return m, errMessageTooLarge
+	}
+	m.Data, err = io.ReadAll(file)
+	if err != nil {
+		return m, errReadBody
+	}
+	if m.ContentType == "" {
+		m.ContentType = header.Header.Get("Content-Type")
+	}
+	return m, nil
+}
+
+func validateMessage(m *Message) error {
+	if m.Payload != nil && m.Data != nil {
+		return errors.New("Message cannot have both payload and data")
+	}
+	if m.DelaySeconds < 0 {
+		return errors.New("Invalid delaySeconds")
+	}
+	if m.DelaySeconds > 0 && m.DeliverAt == nil {
+		at := clock.Now().Add(time.Duration(m.DelaySeconds) * time.Second)
+		m.DeliverAt = &at
+	}
+	if len(m.Attributes) > *maxAttributes {
+		return errors.New("Too many attributes")
+	}
+	if int64(len(m.Message)+len(m.Payload)+len(m.Data)) > *maxMessageSize {
+		return errMessageTooLarge
+	}
+
+	if m.ContentType == "" {
+		switch {
+		case m.Payload != nil:
+			m.ContentType = "application/json"
+		case m.Data != nil:
+			m.ContentType = "application/octet-stream"
+		default:
+			m.ContentType = "text/plain"
+		}
+	}
+	return nil
+}
+
 func handleDeleteMessage(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(r.URL.Path[len("/messages/"):])
 	if err != nil {
@@ -222,12 +698,25 @@ func handleDeleteMessage(w http.ResponseWriter, r *http.Request) {
 	// If you use a two-value assignment for accessing a
 	// value on a map, you get the value first then an
 	// "exists" variable.
-	_, ok := messages[id]
-	if !ok {
+	m, ok := messages[id]
+	if !ok || !ownedBy(requestTenant(r), m.Tenant) {
 		http.Error(w, "Message not found", http.StatusNotFound)
 		return
 	}
 
-	delete(messages, id)
+	removeMessage(m)
 	w.WriteHeader(http.StatusOK)
 }
+
+// removeMessage deletes a message and everything tracking it. The caller
+// must hold messagesMu.
+func removeMessage(m Message) {
+	wasScheduled := isScheduled(m.ID)
+	delete(messages, m.ID)
+	delete(leases, m.ID)
+	delete(scheduled, m.ID)
+	searchIndex.remove(m)
+	if !wasScheduled {
+		recordChange("delete", m)
+	}
+}
@@ -0,0 +1,1298 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var fakeClock = NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+func TestMain(m *testing.M) {
+	// Script tasks run the test binary as their script process.
+	if len(os.Args) > 1 && os.Args[1] == "script" {
+		runScriptProcess(os.Args[2:])
+		return
+	}
+
+	clock = fakeClock
+	*idsFile = ""
+	// The race detector needs more memory than the default script limit.
+	*scriptMaxMemory = 1 << 30
+
+	go counter()
+	go scheduler()
+	for i := 0; i < 10; i++ {
+		go worker()
+	}
+
+	os.Exit(m.Run())
+}
+
+func do(handler http.HandlerFunc, method, target, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rec
+}
+
+// doAsync runs a request that may block, such as waiting for a lock, in
+// the background.
+func doAsync(handler http.HandlerFunc, method, target, body string) <-chan *httptest.ResponseRecorder {
+	ch := make(chan *httptest.ResponseRecorder, 1)
+	go func() { ch <- do(handler, method, target, body) }()
+	return ch
+}
+
+// advanceUntil advances the fake clock a second at a time until the
+// request completes. Leases start their timers in the background, so a
+// single large step could come before the timer exists.
+func advanceUntil(t *testing.T, ch <-chan *httptest.ResponseRecorder) *httptest.ResponseRecorder {
+	t.Helper()
+
+	for i := 0; i < 100; i++ {
+		fakeClock.Advance(time.Second)
+		select {
+		case rec := <-ch:
+			return rec
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Fatal("request still running")
+	return nil
+}
+
+func counts(t *testing.T) map[string]int {
+	t.Helper()
+
+	var c map[string]int
+	if err := json.Unmarshal(do(countHandler, "GET", "/count/", "").Body.Bytes(), &c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// eventually polls cond until it holds, failing the test after a second.
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitAll calls waitHandler and returns a channel closed once it responds.
+func waitAll() chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		do(waitHandler, "GET", "/wait/", "")
+		close(done)
+	}()
+	return done
+}
+
+func TestRunWaitLifecycle(t *testing.T) {
+	before := counts(t)
+
+	rec := do(runHandler, "POST", "/run/", `{"task":{"id":1,"task":"Fetch","sleepDuration":500},"count":5}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("run: got status %d", rec.Code)
+	}
+
+	// Five sleeping tasks plus the message scheduler's timer.
+	fakeClock.BlockUntil(6)
+
+	done := waitAll()
+	select {
+	case <-done:
+		t.Fatal("wait returned before tasks completed")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	fakeClock.Advance(500 * time.Second)
+	<-done
+
+	eventually(t, func() bool {
+		return counts(t)["taskCounter"] == before["taskCounter"]+5
+	})
+	if got := counts(t)["failures"]; got != before["failures"] {
+		t.Errorf("failures: got %d, want %d", got, before["failures"])
+	}
+}
+
+func TestFailedFetchIsCounted(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer target.Close()
+
+	before := counts(t)
+
+	do(runHandler, "POST", "/run/", `{"task":{"id":2,"task":"Fetch","url":"`+target.URL+`"},"count":3}`)
+
+	eventually(t, func() bool {
+		c := counts(t)
+		return c["taskCounter"] == before["taskCounter"]+3 && c["failures"] == before["failures"]+3
+	})
+}
+
+func TestJobAbortsAfterMaxFailures(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer target.Close()
+
+	id := runJob(t, `{"task":{"id":4,"task":"Fetch","url":"`+target.URL+`"},"count":20,"maxFailures":3}`)
+
+	var job Job
+	eventually(t, func() bool {
+		job = getJob(t, id)
+		return job.Finished != nil
+	})
+
+	if job.State != "aborted" || job.Reason == "" {
+		t.Errorf("job: got state %q, reason %q", job.State, job.Reason)
+	}
+	if job.Failed < 3 || job.Failed+job.Drained != 20 {
+		t.Errorf("job: got %d failed, %d drained", job.Failed, job.Drained)
+	}
+}
+
+func TestJobAbortedByLastTask(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer target.Close()
+
+	id := runJob(t, `{"task":{"id":5,"task":"Fetch","url":"`+target.URL+`"},"count":1,"maxFailures":1}`)
+
+	var job Job
+	eventually(t, func() bool {
+		job = getJob(t, id)
+		return job.Finished != nil
+	})
+
+	if job.State != "aborted" || job.Failed != 1 || job.Drained != 0 {
+		t.Errorf("job: got state %q, %d failed, %d drained", job.State, job.Failed, job.Drained)
+	}
+}
+
+func getJob(t *testing.T, id int64) Job {
+	t.Helper()
+
+	var job Job
+	rec := do(jobsHandler, "GET", "/jobs/"+strconv.FormatInt(id, 10), "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func runJob(t *testing.T, body string) int64 {
+	t.Helper()
+
+	var response struct {
+		JobID int64 `json:"jobId"`
+	}
+	rec := do(runHandler, "POST", "/run/", body)
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	return response.JobID
+}
+
+func TestJobsShareWorkers(t *testing.T) {
+	first := runJob(t, `{"task":{"id":5,"task":"Fetch","sleepDuration":1},"count":30}`)
+	// The ten workers plus the message scheduler's timer.
+	fakeClock.BlockUntil(11)
+
+	second := runJob(t, `{"task":{"id":6,"task":"Fetch","sleepDuration":1},"count":10}`)
+	fakeClock.Advance(time.Second)
+	fakeClock.BlockUntil(11)
+
+	if a, b := getJob(t, first), getJob(t, second); a.Running != 5 || b.Running != 5 {
+		t.Errorf("running: got %d and %d tasks, want 5 and 5", a.Running, b.Running)
+	}
+
+	// Two more rounds finish the second job and then the first.
+	for i := 0; i < 2; i++ {
+		fakeClock.Advance(time.Second)
+		fakeClock.BlockUntil(11)
+	}
+	fakeClock.Advance(time.Second)
+	eventually(t, func() bool { return getJob(t, first).Finished != nil })
+
+	if job := getJob(t, second); job.State != "completed" || job.Succeeded != 10 {
+		t.Errorf("second job: got state %q, %d succeeded", job.State, job.Succeeded)
+	}
+}
+
+func TestPanickingTaskIsRecovered(t *testing.T) {
+	defer do(chaosHandler, "PUT", "/admin/chaos", `{}`)
+
+	rec := do(chaosHandler, "PUT", "/admin/chaos", `{"enabled":true,"panicRate":1}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("chaos: got status %d", rec.Code)
+	}
+
+	before := counts(t)
+
+	do(runHandler, "POST", "/run/", `{"task":{"id":3,"task":"Fetch"},"count":2}`)
+
+	eventually(t, func() bool {
+		c := counts(t)
+		return c["taskCounter"] == before["taskCounter"]+2 && c["failures"] == before["failures"]+2
+	})
+}
+
+// messageEvents returns the change events for a message.
+func messageEvents(id int) []ChangeEvent {
+	all, _, _ := changesSince("", 0, 1<<30)
+	var events []ChangeEvent
+	for _, e := range all {
+		if e.MessageID == id {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func TestDelayedMessageBecomesVisible(t *testing.T) {
+	rec := do(messageHandler, "POST", "/messages/", `{"message":"reminder","delaySeconds":60}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("post: got status %d", rec.Code)
+	}
+
+	var m Message
+	if err := json.Unmarshal(rec.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	path := "/messages/" + strconv.Itoa(m.ID)
+
+	if rec := do(messageHandler, "GET", path, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("get before delivery: got status %d", rec.Code)
+	}
+
+	fakeClock.Advance(59 * time.Second)
+	if rec := do(messageHandler, "GET", path, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("get before delivery: got status %d", rec.Code)
+	}
+	if events := messageEvents(m.ID); len(events) != 0 {
+		t.Fatalf("changes before delivery: got %v", events)
+	}
+
+	fakeClock.Advance(time.Second)
+	eventually(t, func() bool {
+		return do(messageHandler, "GET", path, "").Code == http.StatusOK
+	})
+	if events := messageEvents(m.ID); len(events) != 1 || events[0].Type != "create" {
+		t.Errorf("changes after delivery: got %v", events)
+	}
+
+	// Delaying the visible message again hides it until the next delivery.
+	if rec := do(messageHandler, "PUT", path, `{"message":"reminder","delaySeconds":60}`); rec.Code != http.StatusOK {
+		t.Fatalf("put: got status %d", rec.Code)
+	}
+	if rec := do(messageHandler, "GET", path, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("get after hiding: got status %d", rec.Code)
+	}
+	if events := messageEvents(m.ID); len(events) != 2 || events[1].Type != "delete" {
+		t.Errorf("changes after hiding: got %v", events)
+	}
+
+	fakeClock.Advance(time.Minute)
+	eventually(t, func() bool {
+		return do(messageHandler, "GET", path, "").Code == http.StatusOK
+	})
+	if events := messageEvents(m.ID); len(events) != 3 || events[2].Type != "create" {
+		t.Errorf("changes after redelivery: got %v", events)
+	}
+}
+
+func TestScriptStepLimit(t *testing.T) {
+	defer func(steps uint64) { *scriptMaxSteps = steps }(*scriptMaxSteps)
+	*scriptMaxSteps = 1000
+
+	err := scriptTask(Task{ID: 7, Task: "Script", Script: "for i in range(1000000):\n    pass\n"})
+	if err == nil || !strings.Contains(err.Error(), "too many steps") {
+		t.Errorf("got error %v, want too many steps", err)
+	}
+}
+
+func TestScriptTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { *scriptTimeout = timeout }(*scriptTimeout)
+	*scriptTimeout = 10 * time.Second
+
+	done := make(chan error, 1)
+	go func() { done <- scriptTask(Task{ID: 8, Task: "Script", Script: "sleep(60)\n"}) }()
+
+	// The sleep would only end after a minute; the timeout ends it first.
+	for i := 0; i < 50; i++ {
+		fakeClock.Advance(time.Second)
+		select {
+		case err := <-done:
+			if err == nil || !strings.Contains(err.Error(), "timed out") {
+				t.Errorf("got error %v, want timed out", err)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	t.Fatal("script still running")
+}
+
+func TestScriptMemoryLimit(t *testing.T) {
+	// Each string is half a gigabyte, so the list is far past the limit.
+	err := scriptTask(Task{ID: 12, Task: "Script", Script: "x = [(\"x\" * (1 << 29)) + str(i) for i in range(20)]\n"})
+	if err == nil || !strings.Contains(err.Error(), "memory limit") {
+		t.Errorf("got error %v, want memory limit", err)
+	}
+}
+
+func TestResultsRedactEscapedSecrets(t *testing.T) {
+	secretsMu.Lock()
+	previous := redactor
+	redactor = strings.NewReplacer(`s3<cr"t`, "[REDACTED]")
+	secretsMu.Unlock()
+	defer func() {
+		secretsMu.Lock()
+		redactor = previous
+		secretsMu.Unlock()
+	}()
+
+	addResult(Task{ID: 9}, json.RawMessage(`{"token":"s3<cr\"t","n":1}`))
+
+	rec := do(resultsHandler, "GET", "/results/9", "")
+	if body := rec.Body.String(); strings.Contains(body, "s3") || !strings.Contains(body, "[REDACTED]") {
+		t.Errorf("results: got %s", body)
+	}
+}
+
+// signJWT returns a compact JWT with the claims, signed with key: an RSA or
+// ECDSA private key, or an HMAC secret.
+func signJWT(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest[:])
+		if err == nil {
+			signature = make([]byte, 64)
+			r.FillBytes(signature[:32])
+			s.FillBytes(signature[32:])
+		}
+	case []byte:
+		signature = hmacSHA256(k, signed)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTAuthentication(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hsSecret := []byte("a shared secret of at least 32 bytes")
+
+	encode := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "n": encode(rsaKey.N), "e": encode(big.NewInt(int64(rsaKey.E)))},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": encode(ecKey.X), "y": encode(ecKey.Y)},
+	}})
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		*jwksSource, *jwtSecret, *jwtAudience = "", "", ""
+		jwksMu.Lock()
+		jwksKeys = make(map[string]interface{})
+		jwksMu.Unlock()
+	}()
+	*jwksSource, *jwtSecret, *jwtAudience = path, string(hsSecret), "highway"
+	if err := loadJWKS(); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub":   "tester",
+			"aud":   "highway",
+			"exp":   clock.Now().Add(time.Hour).Unix(),
+			"scope": "kv:read",
+		}
+		for k, v := range changes {
+			c[k] = v
+		}
+		return c
+	}
+	rsaPublic, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"rs256", signJWT(t, "RS256", "rsa", rsaKey, claims(nil)), http.StatusOK},
+		{"es256", signJWT(t, "ES256", "ec", ecKey, claims(nil)), http.StatusOK},
+		{"hs256", signJWT(t, "HS256", "", hsSecret, claims(nil)), http.StatusOK},
+		{"audience list", signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"aud": []string{"other", "highway"}})), http.StatusOK},
+		{"hs256 signed with the rsa public key", signJWT(t, "HS256", "rsa", rsaPublic, claims(nil)), http.StatusUnauthorized},
+		{"rs256 header on an hmac signature", signJWT(t, "RS256", "rsa", hsSecret, claims(nil)), http.StatusUnauthorized},
+		{"rsa key used as es256", signJWT(t, "ES256", "rsa", ecKey, claims(nil)), http.StatusUnauthorized},
+		{"alg none", signJWT(t, "none", "rsa", []byte{}, claims(nil)), http.StatusUnauthorized},
+		{"wrong key", signJWT(t, "HS256", "", []byte("another secret"), claims(nil)), http.StatusUnauthorized},
+		{"expired", signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"exp": clock.Now().Add(-2 * jwtLeeway).Unix()})), http.StatusUnauthorized},
+		{"wrong audience", signJWT(t, "ES256", "ec", ecKey, claims(map[string]interface{}{"aud": "other"})), http.StatusUnauthorized},
+		{"missing scope", signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"scope": "kv:write"})), http.StatusForbidden},
+		{"admin scope", signJWT(t, "RS256", "rsa", rsaKey, claims(map[string]interface{}{"scope": "admin"})), http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/kv/key", nil)
+		req.Header.Set("Authorization", "Bearer "+test.token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.want {
+			t.Errorf("%s: got status %d, want %d: %s", test.name, rec.Code, test.want, rec.Body.String())
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/kv/key", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("no token: got status %d", rec.Code)
+	}
+}
+
+func TestJWKSRefetchIsLimited(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		<-release
+		http.Error(w, "Unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	fetches := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+
+	defer func() { *jwksSource = "" }()
+	*jwksSource = server.URL
+	jwksMu.Lock()
+	jwksAttempted = time.Time{}
+	jwksMu.Unlock()
+
+	// Requests with an unknown key share one fetch.
+	var lookups sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		lookups.Add(1)
+		go func() {
+			defer lookups.Done()
+			lookupKey("rotated")
+		}()
+	}
+	eventually(t, func() bool { return fetches() == 1 })
+	close(release)
+	lookups.Wait()
+
+	// The failed fetch counts as an attempt.
+	lookupKey("rotated")
+	if n := fetches(); n != 1 {
+		t.Errorf("after a failed fetch: got %d fetches, want 1", n)
+	}
+	fakeClock.Advance(jwksMinRefetch)
+	lookupKey("rotated")
+	if n := fetches(); n != 2 {
+		t.Errorf("after the minimum refetch time: got %d fetches, want 2", n)
+	}
+}
+
+func TestTenantsAreIsolated(t *testing.T) {
+	secret := []byte("a shared secret of at least 32 bytes")
+	defer func() { *jwtSecret = "" }()
+	*jwtSecret = string(secret)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/kv/", kvHandler)
+	mux.HandleFunc("/counters/", counterHandler)
+	mux.HandleFunc("/locks/", lockHandler)
+	mux.HandleFunc("/messages/", messageHandler)
+	mux.HandleFunc("/count/", countHandler)
+	handler := authMiddleware(mux)
+
+	token := func(tenant, scope string) string {
+		return signJWT(t, "HS256", "", secret, map[string]interface{}{
+			"sub":    "tester",
+			"tenant": tenant,
+			"exp":    clock.Now().Add(time.Hour).Unix(),
+			"scope":  scope,
+		})
+	}
+	scopes := "kv:read kv:write coordination:read coordination:write messages:read messages:write tasks:read"
+	acme, globex, admin := token("acme", scopes), token("globex", scopes), token("acme", "admin")
+	call := func(token, method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name                  string
+		token, method, target string
+		want                  int
+	}{
+		{"own key", acme, "PUT", "/kv/acme/color", http.StatusOK},
+		{"key outside the tenant", acme, "PUT", "/kv/color", http.StatusForbidden},
+		{"key of another tenant", globex, "GET", "/kv/acme/color", http.StatusForbidden},
+		{"range over all keys", acme, "GET", "/kv/?prefix=1", http.StatusForbidden},
+		{"admin", admin, "GET", "/kv/acme/color", http.StatusOK},
+		{"server-wide counts", acme, "GET", "/count/", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		if rec := call(test.token, test.method, test.target, `{"value":"red"}`); rec.Code != test.want {
+			t.Errorf("%s: got status %d, want %d: %s", test.name, rec.Code, test.want, rec.Body.String())
+		}
+	}
+
+	call(acme, "POST", "/counters/acme/hits/incr", `{}`)
+	call(globex, "POST", "/counters/globex/hits/incr", `{}`)
+	if body := call(acme, "GET", "/counters/", "").Body.String(); !strings.Contains(body, "acme/hits") || strings.Contains(body, "globex") {
+		t.Errorf("counters of acme: got %s", body)
+	}
+	var lock LockState
+	json.Unmarshal(call(globex, "POST", "/locks/globex/deploy/acquire", `{}`).Body.Bytes(), &lock)
+	defer call(globex, "POST", "/locks/globex/deploy/release", `{"leaseId":"`+lock.LeaseID+`"}`)
+	if rec := call(acme, "GET", "/locks/", ""); rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "globex") {
+		t.Errorf("locks of acme: got status %d, body %s", rec.Code, rec.Body)
+	}
+
+	var m Message
+	if err := json.Unmarshal(call(acme, "POST", "/messages/", `{"message":"for acme","tenant":"globex"}`).Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Tenant != "acme" {
+		t.Errorf("message tenant: got %q, want acme", m.Tenant)
+	}
+	path := "/messages/" + strconv.Itoa(m.ID)
+	if rec := call(globex, "GET", path, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("message of another tenant: got status %d", rec.Code)
+	}
+	if rec := call(globex, "DELETE", path, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("delete message of another tenant: got status %d", rec.Code)
+	}
+	if body := call(globex, "POST", "/messages/receive?max=100", "").Body.String(); strings.Contains(body, "for acme") {
+		t.Errorf("receive by another tenant: got %s", body)
+	}
+	if body := call(acme, "POST", "/messages/receive?max=100", "").Body.String(); !strings.Contains(body, "for acme") {
+		t.Errorf("receive by acme: got %s", body)
+	}
+}
+
+func TestSearchQueryAndHighlight(t *testing.T) {
+	clauses := parseQuery("deploy *")
+	if len(clauses) != 1 || clauses[0].prefix {
+		t.Errorf("lone *: got clauses %+v", clauses)
+	}
+	clauses = parseQuery("fail* ok")
+	if len(clauses) != 2 || !clauses[0].prefix || clauses[1].prefix {
+		t.Errorf("prefix: got clauses %+v", clauses)
+	}
+
+	got := highlight(`<script>deploy</script> & deploy`, []string{"deploy"})
+	want := `&lt;script&gt;<em>deploy</em>&lt;/script&gt; &amp; <em>deploy</em>`
+	if got != want {
+		t.Errorf("highlight: got %q, want %q", got, want)
+	}
+}
+
+func TestExpiredKeyIsGone(t *testing.T) {
+	if rec := do(kvHandler, "PUT", "/kv/session", `{"value":"a","ttlSeconds":1}`); rec.Code != http.StatusOK {
+		t.Fatalf("put: got status %d", rec.Code)
+	}
+	fakeClock.Advance(time.Second)
+
+	if rec := do(kvHandler, "GET", "/kv/session", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("get: got status %d", rec.Code)
+	}
+	if rec := do(kvHandler, "GET", "/kv/sess?prefix=1", ""); strings.Contains(rec.Body.String(), `"session"`) {
+		t.Errorf("range: got %s", rec.Body.String())
+	}
+	if rec := do(kvHandler, "PUT", "/kv/session", `{"value":"b","prevRevision":0}`); rec.Code != http.StatusOK {
+		t.Errorf("create after expiry: got status %d", rec.Code)
+	}
+}
+
+func TestShortLivedTokenIsReused(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"access_token":"token-` + strconv.Itoa(requests) + `","expires_in":20}`))
+	}))
+	defer server.Close()
+
+	profile := CredentialProfile{Name: "short", Type: "oauth2", TokenURL: server.URL, ClientID: "client"}
+	cache := &cachedToken{}
+	for i := 0; i < 2; i++ {
+		if _, err := cache.get(profile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("got %d token requests before expiry, want 1", requests)
+	}
+
+	fakeClock.Advance(15 * time.Second)
+	if token, err := cache.get(profile); err != nil || token != "token-2" {
+		t.Errorf("after skew: got %q, %v", token, err)
+	}
+}
+
+func TestTargetRejectsInvalidConfig(t *testing.T) {
+	target := &targetServer{position: make(map[string]int)}
+	for _, config := range []string{
+		`{"default":{"payloadSize":-1}}`,
+		`{"default":{"errorRate":1.5}}`,
+		`{"routes":{"/slow":{"timeoutRate":-0.1}}}`,
+		`{"default":{"statuses":[{"code":1000,"weight":1}]}}`,
+	} {
+		if rec := do(target.configHandler, "PUT", "/_target/config", config); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d", config, rec.Code)
+		}
+	}
+	if rec := do(target.configHandler, "PUT", "/_target/config", `{"default":{"payloadSize":10,"errorRate":0.5}}`); rec.Code != http.StatusOK {
+		t.Errorf("valid config: got status %d", rec.Code)
+	}
+}
+
+func TestSlidingLogRetryAfter(t *testing.T) {
+	if rec := do(limiterHandler, "PUT", "/limiters/log", `{"algorithm":"sliding_log","limit":5,"period":"10s"}`); rec.Code != http.StatusOK {
+		t.Fatalf("put: got status %d", rec.Code)
+	}
+	defer do(limiterHandler, "DELETE", "/limiters/log", "")
+
+	take := func(n int) (TakeResult, int) {
+		var result TakeResult
+		rec := do(limiterHandler, "POST", "/limiters/log/take", `{"n":`+strconv.Itoa(n)+`}`)
+		json.Unmarshal(rec.Body.Bytes(), &result)
+		return result, rec.Code
+	}
+
+	take(3)
+	fakeClock.Advance(2 * time.Second)
+	take(2)
+	fakeClock.Advance(time.Second)
+
+	// Four units are free once both takes have left the log.
+	if result, code := take(4); code != http.StatusTooManyRequests || result.RetryAfter != 9 {
+		t.Errorf("take: got status %d, %+v", code, result)
+	}
+	fakeClock.Advance(7 * time.Second)
+	if result, code := take(3); code != http.StatusOK || result.Remaining != 0 {
+		t.Errorf("take after the first left: got status %d, %+v", code, result)
+	}
+}
+
+func TestDeleteWaitGroupWithWaiters(t *testing.T) {
+	do(waitGroupHandler, "POST", "/waitgroups/deploy/add", `{"delta":1}`)
+
+	waited := make(chan int, 1)
+	go func() { waited <- do(waitGroupHandler, "GET", "/waitgroups/deploy/wait", "").Code }()
+	eventually(t, func() bool {
+		return strings.Contains(do(waitGroupHandler, "GET", "/waitgroups/deploy", "").Body.String(), `"waiters":1`)
+	})
+
+	if rec := do(waitGroupHandler, "DELETE", "/waitgroups/deploy", ""); rec.Code != http.StatusConflict {
+		t.Errorf("delete with waiters: got status %d", rec.Code)
+	}
+	do(waitGroupHandler, "POST", "/waitgroups/deploy/done", "")
+	if code := <-waited; code != http.StatusOK {
+		t.Errorf("wait: got status %d", code)
+	}
+	if rec := do(waitGroupHandler, "DELETE", "/waitgroups/deploy", ""); rec.Code != http.StatusOK {
+		t.Errorf("delete: got status %d", rec.Code)
+	}
+}
+
+func TestIdleWaitGroupWithCountIsKept(t *testing.T) {
+	defer do(waitGroupHandler, "DELETE", "/waitgroups/pending", "")
+	do(waitGroupHandler, "POST", "/waitgroups/pending/add", `{"delta":2}`)
+	do(waitGroupHandler, "POST", "/waitgroups/finished/add", `{"delta":1}`)
+	do(waitGroupHandler, "POST", "/waitgroups/finished/done", "")
+
+	fakeClock.Advance(*idleTimeout + time.Second)
+	removeIdleCoordination()
+
+	if rec := do(waitGroupHandler, "GET", "/waitgroups/pending", ""); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"count":2`) {
+		t.Errorf("pending: got status %d, body %s", rec.Code, rec.Body)
+	}
+	if rec := do(waitGroupHandler, "GET", "/waitgroups/finished", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("finished: got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestScenarioVariablesCannotReferenceSecrets(t *testing.T) {
+	secretsMu.Lock()
+	secretValues["db_password"] = "hunter2-hunter2"
+	secretsMu.Unlock()
+	defer func() {
+		secretsMu.Lock()
+		delete(secretValues, "db_password")
+		secretsMu.Unlock()
+	}()
+
+	var echoed string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bait" {
+			w.Write([]byte("${secret:db_password}"))
+			return
+		}
+		echoed = r.URL.Query().Get("v")
+	}))
+	defer server.Close()
+
+	err := scenarioTask(Task{ID: 10, Task: "Scenario", Steps: []ScenarioStep{
+		{URL: server.URL + "/bait", Extract: []Extraction{{Var: "v", Regex: "(.*)"}}},
+		{URL: server.URL + "/echo?v={{v}}"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if echoed != "${secret:db_password}" {
+		t.Errorf("second step sent %q", echoed)
+	}
+}
+
+func TestScenarioStepsShareCookiesAndVariables(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "s-1"})
+			w.Header().Set("X-Request-Id", "r-7")
+			w.Write([]byte(`{"data":{"token":"t-1"}}`))
+		case "/profile":
+			cookie, err := r.Cookie("session")
+			if err != nil || cookie.Value != "s-1" || r.Header.Get("Authorization") != "Bearer t-1" || r.Header.Get("X-Trace") != "r-7" {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte("user id=42;"))
+		case "/orders/42":
+			w.Write([]byte(strings.Repeat("order ", 10)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	err := scenarioTask(Task{ID: 13, Task: "Scenario", Steps: []ScenarioStep{
+		{Name: "login", Method: "POST", URL: server.URL + "/login", Extract: []Extraction{
+			{Var: "token", JSONPath: "$.data.token"},
+			{Var: "request", Header: "X-Request-Id"},
+		}},
+		{Name: "profile", URL: server.URL + "/profile", Headers: map[string]string{
+			"Authorization": "Bearer {{token}}",
+			"X-Trace":       "{{request}}",
+		}, ExpectStatus: http.StatusOK, Extract: []Extraction{{Var: "user", Regex: `id=(\d+)`}}},
+		{Name: "orders", URL: server.URL + "/orders/{{user}}", ExpectStatus: http.StatusCreated},
+	}})
+	if err == nil || err.Error() != "step orders: expected status 201, got 200" {
+		t.Errorf("got error %v", err)
+	}
+
+	var runs []struct {
+		Steps []StepResult `json:"steps"`
+	}
+	rec := do(resultsHandler, "GET", "/results/13", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &runs); err != nil || len(runs) == 0 {
+		t.Fatalf("results: got %s", rec.Body)
+	}
+	if steps := runs[len(runs)-1].Steps; len(steps) != 3 || steps[1].Status != http.StatusOK || steps[2].Error == "" {
+		t.Errorf("results: got %+v", steps)
+	}
+
+	defer func(max int64) { *scenarioMaxBody = max }(*scenarioMaxBody)
+	*scenarioMaxBody = 16
+	err = scenarioTask(Task{ID: 14, Task: "Scenario", Steps: []ScenarioStep{{URL: server.URL + "/orders/42"}}})
+	if err == nil || !strings.Contains(err.Error(), "exceeds 16 bytes") {
+		t.Errorf("large body: got error %v", err)
+	}
+}
+
+func TestLockPassesToWaitersInOrder(t *testing.T) {
+	decode := func(rec *httptest.ResponseRecorder) LockState {
+		t.Helper()
+		var s LockState
+		if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+			t.Fatalf("got status %d, body %s", rec.Code, rec.Body)
+		}
+		return s
+	}
+	waiters := func() int { return decode(do(lockHandler, "GET", "/locks/migrate", "")).Waiters }
+
+	first := decode(do(lockHandler, "POST", "/locks/migrate/acquire", `{"holder":"a","ttlSeconds":10}`))
+	b := doAsync(lockHandler, "POST", "/locks/migrate/acquire", `{"holder":"b","ttlSeconds":60,"waitSeconds":300}`)
+	eventually(t, func() bool { return waiters() == 1 })
+	c := doAsync(lockHandler, "POST", "/locks/migrate/acquire", `{"holder":"c","ttlSeconds":60,"waitSeconds":300}`)
+	eventually(t, func() bool { return waiters() == 2 })
+
+	if rec := do(lockHandler, "POST", "/locks/migrate/renew", `{"leaseId":"unknown"}`); rec.Code != http.StatusConflict {
+		t.Errorf("renew with unknown lease: got status %d", rec.Code)
+	}
+
+	// The first lease is not renewed, so the lock passes to b once it
+	// expires, with a higher fencing token.
+	second := decode(advanceUntil(t, b))
+	if second.Holder != "b" || second.FencingToken <= first.FencingToken {
+		t.Errorf("after expiry: got holder %q with token %d after %d", second.Holder, second.FencingToken, first.FencingToken)
+	}
+	if rec := do(lockHandler, "POST", "/locks/migrate/renew", `{"leaseId":"`+first.LeaseID+`"}`); rec.Code != http.StatusConflict {
+		t.Errorf("renew with expired lease: got status %d", rec.Code)
+	}
+
+	if rec := do(lockHandler, "POST", "/locks/migrate/release", `{"leaseId":"`+second.LeaseID+`"}`); rec.Code != http.StatusOK {
+		t.Fatalf("release: got status %d", rec.Code)
+	}
+	third := decode(<-c)
+	if third.Holder != "c" || third.FencingToken <= second.FencingToken {
+		t.Errorf("after release: got holder %q with token %d after %d", third.Holder, third.FencingToken, second.FencingToken)
+	}
+	do(lockHandler, "POST", "/locks/migrate/release", `{"leaseId":"`+third.LeaseID+`"}`)
+}
+
+func TestElectionTermsIncrease(t *testing.T) {
+	decode := func(rec *httptest.ResponseRecorder) ElectionState {
+		t.Helper()
+		var s ElectionState
+		if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+			t.Fatalf("got status %d, body %s", rec.Code, rec.Body)
+		}
+		return s
+	}
+
+	first := decode(do(electionHandler, "POST", "/elections/primary/campaign", `{"candidate":"a","ttlSeconds":10}`))
+	b := doAsync(electionHandler, "POST", "/elections/primary/campaign", `{"candidate":"b","ttlSeconds":60,"waitSeconds":300}`)
+	eventually(t, func() bool {
+		return decode(do(electionHandler, "GET", "/elections/primary", "")).Candidates == 1
+	})
+
+	if rec := do(electionHandler, "POST", "/elections/primary/renew", `{"leaseId":"unknown"}`); rec.Code != http.StatusConflict {
+		t.Errorf("renew with unknown lease: got status %d", rec.Code)
+	}
+
+	// The leader does not renew its lease, so b takes over in a new term.
+	second := decode(advanceUntil(t, b))
+	if second.Leader != "b" || second.Term <= first.Term {
+		t.Errorf("after expiry: got leader %q in term %d after %d", second.Leader, second.Term, first.Term)
+	}
+	if rec := do(electionHandler, "POST", "/elections/primary/renew", `{"leaseId":"`+first.LeaseID+`"}`); rec.Code != http.StatusConflict {
+		t.Errorf("renew by the former leader: got status %d", rec.Code)
+	}
+
+	if rec := do(electionHandler, "POST", "/elections/primary/resign", `{"leaseId":"`+second.LeaseID+`"}`); rec.Code != http.StatusOK {
+		t.Fatalf("resign: got status %d", rec.Code)
+	}
+	third := decode(do(electionHandler, "POST", "/elections/primary/campaign", `{"candidate":"a"}`))
+	if third.Leader != "a" || third.Term <= second.Term {
+		t.Errorf("after resigning: got leader %q in term %d after %d", third.Leader, third.Term, second.Term)
+	}
+	do(electionHandler, "POST", "/elections/primary/resign", `{"leaseId":"`+third.LeaseID+`"}`)
+}
+
+func TestSemaphoreServesWaitersInOrder(t *testing.T) {
+	decode := func(rec *httptest.ResponseRecorder) SemaphoreGrant {
+		t.Helper()
+		var g SemaphoreGrant
+		if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &g) != nil {
+			t.Fatalf("got status %d, body %s", rec.Code, rec.Body)
+		}
+		return g
+	}
+	waiters := func() int {
+		var s SemaphoreState
+		json.Unmarshal(do(semaphoreHandler, "GET", "/semaphores/builds", "").Body.Bytes(), &s)
+		return len(s.Waiters)
+	}
+
+	do(semaphoreHandler, "PUT", "/semaphores/builds", `{"capacity":3}`)
+	a := decode(do(semaphoreHandler, "POST", "/semaphores/builds/acquire", `{"holder":"a","permits":2}`))
+	b := doAsync(semaphoreHandler, "POST", "/semaphores/builds/acquire", `{"holder":"b","permits":2,"waitSeconds":300}`)
+	eventually(t, func() bool { return waiters() == 1 })
+
+	// One permit is free, but b is queued ahead and needs two.
+	if rec := do(semaphoreHandler, "POST", "/semaphores/builds/acquire", `{"holder":"c","permits":1}`); rec.Code != http.StatusConflict {
+		t.Errorf("acquire past a waiter: got status %d", rec.Code)
+	}
+	c := doAsync(semaphoreHandler, "POST", "/semaphores/builds/acquire", `{"holder":"c","permits":1,"waitSeconds":300}`)
+	eventually(t, func() bool { return waiters() == 2 })
+	select {
+	case rec := <-c:
+		t.Fatalf("c acquired ahead of b: got status %d", rec.Code)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Releasing a's permits lets b in, and c fits in the permit left.
+	do(semaphoreHandler, "POST", "/semaphores/builds/release", `{"leaseId":"`+a.LeaseID+`"}`)
+	for _, g := range []SemaphoreGrant{decode(<-b), decode(<-c)} {
+		do(semaphoreHandler, "POST", "/semaphores/builds/release", `{"leaseId":"`+g.LeaseID+`"}`)
+	}
+	if rec := do(semaphoreHandler, "DELETE", "/semaphores/builds", ""); rec.Code != http.StatusOK {
+		t.Errorf("delete: got status %d", rec.Code)
+	}
+}
+
+func TestGroupedMessagesAreDeliveredInOrder(t *testing.T) {
+	ids := make(map[string]int)
+	for _, body := range []string{
+		`{"message":"first of 1","groupKey":"orders-1"}`,
+		`{"message":"second of 1","groupKey":"orders-1"}`,
+		`{"message":"first of 2","groupKey":"orders-2"}`,
+	} {
+		var m Message
+		if err := json.Unmarshal(do(messageHandler, "POST", "/messages/", body).Body.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+		ids[m.Message] = m.ID
+	}
+
+	// receive returns the receipts of the received messages of the test.
+	receive := func() map[string]string {
+		t.Helper()
+		var received []ReceivedMessage
+		rec := do(messageHandler, "POST", "/messages/receive?max=100&visibility=10s", "")
+		if err := json.Unmarshal(rec.Body.Bytes(), &received); err != nil {
+			t.Fatalf("receive: got status %d, body %s", rec.Code, rec.Body)
+		}
+		receipts := make(map[string]string)
+		for _, r := range received {
+			if strings.HasPrefix(r.Message.GroupKey, "orders-") {
+				receipts[r.Message.Message] = r.Receipt
+			}
+		}
+		return receipts
+	}
+	ack := func(message, receipt string) int {
+		return do(messageHandler, "POST", "/messages/ack", fmt.Sprintf(`{"id":%d,"receipt":%q}`, ids[message], receipt)).Code
+	}
+
+	// Only the head of each group is delivered, but groups do not wait for
+	// each other.
+	got := receive()
+	if len(got) != 2 || got["first of 1"] == "" || got["first of 2"] == "" {
+		t.Fatalf("first receive: got %v", got)
+	}
+	if again := receive(); len(again) != 0 {
+		t.Errorf("receive while heads are leased: got %v", again)
+	}
+
+	// Acknowledging the head releases the next message of its group.
+	if code := ack("first of 1", got["first of 1"]); code != http.StatusOK {
+		t.Errorf("ack: got status %d", code)
+	}
+	next := receive()
+	if len(next) != 1 || next["second of 1"] == "" {
+		t.Fatalf("receive after ack: got %v", next)
+	}
+
+	// Expired leases make their messages visible again, and their receipts
+	// can no longer be used.
+	fakeClock.Advance(11 * time.Second)
+	if code := ack("second of 1", next["second of 1"]); code != http.StatusConflict {
+		t.Errorf("ack after expiry: got status %d", code)
+	}
+	again := receive()
+	if len(again) != 2 || again["second of 1"] == "" || again["first of 2"] == "" {
+		t.Fatalf("receive after expiry: got %v", again)
+	}
+	for message, receipt := range again {
+		if code := ack(message, receipt); code != http.StatusOK {
+			t.Errorf("ack %q: got status %d", message, code)
+		}
+	}
+}
+
+func TestListMessagesFiltersByAttributesAndContentType(t *testing.T) {
+	for _, body := range []string{
+		`{"message":"a","attributes":{"suite":"filters","team":"red"}}`,
+		`{"message":"b","attributes":{"suite":"filters","team":"blue"}}`,
+		`{"message":"c","attributes":{"suite":"filters","team":"red"},"payload":{"n":1}}`,
+	} {
+		var m Message
+		if err := json.Unmarshal(do(messageHandler, "POST", "/messages/", body).Body.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+		defer do(messageHandler, "DELETE", "/messages/"+strconv.Itoa(m.ID), "")
+	}
+
+	list := func(query string) string {
+		var messages []Message
+		json.Unmarshal(do(messageHandler, "GET", "/messages/?attr.suite=filters&"+query, "").Body.Bytes(), &messages)
+		var texts []string
+		for _, m := range messages {
+			texts = append(texts, m.Message)
+		}
+		return strings.Join(texts, ",")
+	}
+	tests := []struct{ query, want string }{
+		{"", "a,b,c"},
+		{"attr.team=red", "a,c"},
+		{"attr.team=red&contentType=text/plain", "a"},
+		{"contentType=application/json", "c"},
+		{"attr.team=green", ""},
+	}
+	for _, test := range tests {
+		if got := list(test.query); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestLargeMessageIsRejected(t *testing.T) {
+	defer func(size int64) { *maxMessageSize = size }(*maxMessageSize)
+	*maxMessageSize = 1024
+
+	body := `{"message":"` + strings.Repeat("x", 2048) + `"}`
+	if rec := do(messageHandler, "POST", "/messages/", body); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("json: got status %d", rec.Code)
+	}
+
+	var upload bytes.Buffer
+	form := multipart.NewWriter(&upload)
+	file, _ := form.CreateFormFile("file", "large.bin")
+	file.Write(make([]byte, 128<<10))
+	form.Close()
+	req := httptest.NewRequest("POST", "/messages/", &upload)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec := httptest.NewRecorder()
+	messageHandler(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("multipart: got status %d", rec.Code)
+	}
+}
+
+func TestChangesSinceLimitAndRetention(t *testing.T) {
+	messagesMu.Lock()
+	base := nextSeq - 1
+	savedLog, savedTruncated := changeLog, truncatedSeq
+	messagesMu.Unlock()
+	defer func(retention int) {
+		*changesRetention = retention
+		messagesMu.Lock()
+		changeLog, truncatedSeq = savedLog, savedTruncated
+		messagesMu.Unlock()
+	}(*changesRetention)
+
+	for _, body := range []string{`{"message":"one"}`, `{"message":"two"}`, `{"message":"three"}`} {
+		var m Message
+		if err := json.Unmarshal(do(messageHandler, "POST", "/messages/", body).Body.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+		defer do(messageHandler, "DELETE", "/messages/"+strconv.Itoa(m.ID), "")
+	}
+
+	changes := func(since int64, limit int) (int, []ChangeEvent) {
+		rec := do(messageHandler, "GET", fmt.Sprintf("/messages/changes?since=%d&limit=%d", since, limit), "")
+		var events []ChangeEvent
+		json.Unmarshal(rec.Body.Bytes(), &events)
+		return rec.Code, events
+	}
+	if _, events := changes(base, 2); len(events) != 2 || events[0].Seq != base+1 || events[0].Message.Message != "one" {
+		t.Fatalf("first page: got %+v", events)
+	}
+	if _, events := changes(base+2, 10); len(events) != 1 || events[0].Message.Message != "three" {
+		t.Errorf("second page: got %+v", events)
+	}
+
+	// Retention drops all but the latest event, so consumers behind it
+	// must resync.
+	*changesRetention = 1
+	compactChanges()
+	if code, _ := changes(base, 10); code != http.StatusGone {
+		t.Errorf("since a dropped event: got status %d", code)
+	}
+	if code, events := changes(base+2, 10); code != http.StatusOK || len(events) != 1 {
+		t.Errorf("since the last dropped event: got status %d, events %+v", code, events)
+	}
+}
+
+func TestCounterUpdates(t *testing.T) {
+	defer do(counterHandler, "DELETE", "/counters/updates", "")
+	state := func(rec *httptest.ResponseRecorder) CounterState {
+		var s CounterState
+		if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+			t.Fatalf("%d %s", rec.Code, rec.Body)
+		}
+		return s
+	}
+
+	do(counterHandler, "POST", "/counters/updates/add", `{"delta":5}`)
+	rec := do(counterHandler, "POST", "/counters/updates/cas", `{"expected":4,"value":10}`)
+	if s := state(rec); rec.Code != http.StatusConflict || s.Value != 5 {
+		t.Errorf("cas with a stale value: got %d %+v", rec.Code, s)
+	}
+	rec = do(counterHandler, "POST", "/counters/updates/cas", `{"expected":5,"value":10}`)
+	if s := state(rec); rec.Code != http.StatusOK || s.Value != 10 {
+		t.Errorf("cas: got %d %+v", rec.Code, s)
+	}
+
+	if s := state(do(counterHandler, "POST", "/counters/updates/reset", `{}`)); s.Value != 10 {
+		t.Errorf("reset: got %+v, want the previous value", s)
+	}
+	if s := state(do(counterHandler, "GET", "/counters/updates", "")); s.Value != 0 {
+		t.Errorf("after reset: got %+v", s)
+	}
+
+	do(counterHandler, "POST", "/counters/updates/incr", `{"ttlSeconds":10}`)
+	fakeClock.Advance(9 * time.Second)
+	if rec := do(counterHandler, "GET", "/counters/updates", ""); rec.Code != http.StatusOK {
+		t.Errorf("before expiry: got %d", rec.Code)
+	}
+	fakeClock.Advance(time.Second)
+	if rec := do(counterHandler, "GET", "/counters/updates", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("after expiry: got %d", rec.Code)
+	}
+}
+
+func TestSequenceSkipsReservedBlockAfterReload(t *testing.T) {
+	idsMu.Lock()
+	saved := sequences
+	sequences = make(map[string]*sequence)
+	idsMu.Unlock()
+	defer func(file string) {
+		*idsFile = file
+		idsMu.Lock()
+		sequences = saved
+		idsMu.Unlock()
+	}(*idsFile)
+	*idsFile = filepath.Join(t.TempDir(), "ids.json")
+
+	next := func() int64 {
+		var resp struct{ IDs []int64 }
+		json.Unmarshal(do(idsHandler, "POST", "/ids/sequences/orders?count=3", "").Body.Bytes(), &resp)
+		if len(resp.IDs) != 3 {
+			t.Fatalf("got IDs %v", resp.IDs)
+		}
+		return resp.IDs[0]
+	}
+	if first := next(); first != 1 {
+		t.Fatalf("first ID: got %d", first)
+	}
+
+	// A restart forgets the IDs handed out and continues past the block
+	// reserved for them.
+	idsMu.Lock()
+	sequences = make(map[string]*sequence)
+	idsMu.Unlock()
+	if err := loadIDs(); err != nil {
+		t.Fatal(err)
+	}
+	if first := next(); first != *idBlockSize+1 {
+		t.Errorf("first ID after reload: got %d, want %d", first, *idBlockSize+1)
+	}
+}
+
+func TestULIDsSortWithinMillisecond(t *testing.T) {
+	var resp struct{ IDs []string }
+	json.Unmarshal(do(idsHandler, "POST", "/ids/ulid?count=100", "").Body.Bytes(), &resp)
+	if len(resp.IDs) != 100 {
+		t.Fatalf("got %d IDs", len(resp.IDs))
+	}
+	// The fake clock stands still, so all IDs share a timestamp.
+	for i := 1; i < len(resp.IDs); i++ {
+		if resp.IDs[i][:10] != resp.IDs[0][:10] || resp.IDs[i] <= resp.IDs[i-1] {
+			t.Fatalf("ULID %d: %s after %s", i, resp.IDs[i], resp.IDs[i-1])
+		}
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	defer func(origins string) { *corsOrigins = origins }(*corsOrigins)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("preflight reached the handler")
+	})
+	preflight := func(origin string) http.Header {
+		r := httptest.NewRequest("OPTIONS", "/messages/", nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", "PUT")
+		w := httptest.NewRecorder()
+		corsMiddleware(next).ServeHTTP(w, r)
+		if w.Code != http.StatusNoContent {
+			t.Errorf("preflight from %s: got status %d", origin, w.Code)
+		}
+		return w.Header()
+	}
+
+	*corsOrigins = "https://app.example.com, https://admin.example.com"
+	h := preflight("https://admin.example.com")
+	if got := h.Get("Access-Control-Allow-Origin"); got != "https://admin.example.com" {
+		t.Errorf("allowed origin: got Access-Control-Allow-Origin %q", got)
+	}
+	if got := h.Get("Access-Control-Allow-Methods"); got != *corsMethods {
+		t.Errorf("allowed origin: got Access-Control-Allow-Methods %q", got)
+	}
+
+	h = preflight("https://evil.example.com")
+	if h.Get("Access-Control-Allow-Origin") != "" || h.Get("Access-Control-Allow-Methods") != "" {
+		t.Errorf("disallowed origin: got headers %v", h)
+	}
+
+	*corsOrigins = "*"
+	h = preflight("https://evil.example.com")
+	if got := h.Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("wildcard: got Access-Control-Allow-Origin %q", got)
+	}
+	if h.Get("Access-Control-Allow-Methods") == "" {
+		t.Errorf("wildcard: missing Access-Control-Allow-Methods")
+	}
+}
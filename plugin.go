@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Plugins are external executables handling custom task types. They speak
+// newline-delimited JSON over stdin and stdout: on startup the plugin
+// writes a pluginHandshake, after which the server writes pluginRequests
+// and the plugin answers each with a pluginResponse carrying the same ID.
+// Requests may be answered out of order.
+
+type pluginHandshake struct {
+	Protocol  int      `json:"protocol"`
+	Name      string   `json:"name"`
+	TaskTypes []string `json:"taskTypes"`
+}
+
+type pluginRequest struct {
+	ID   int64 `json:"id"`
+	Task Task  `json:"task"`
+}
+
+type pluginResponse struct {
+	ID     int64           `json:"id"`
+	Error  string          `json:"error,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+type pluginList []string
+
+func (l *pluginList) String() string     { return strings.Join(*l, ",") }
+func (l *pluginList) Set(v string) error { *l = append(*l, v); return nil }
+
+var (
+	pluginPaths            pluginList
+	pluginTimeout          = flag.Duration("plugin-timeout", time.Minute, "maximum time a plugin may take to run a task")
+	pluginHandshakeTimeout = flag.Duration("plugin-handshake-timeout", 10*time.Second, "maximum time a plugin may take to start")
+)
+
+// builtinTaskTypes are the task types the server runs itself, which
+// plugins may not take over.
+var builtinTaskTypes = make(map[string]bool)
+
+func init() {
+	flag.Var(&pluginPaths, "plugin", "path of a task plugin executable (repeatable)")
+
+	for taskType := range taskHandlers {
+		builtinTaskTypes[taskType] = true
+	}
+}
+
+const pluginProtocol = 1
+
+type plugin struct {
+	path string
+	// writeMu serializes requests written to stdin, so a slow plugin does
+	// not hold up mu.
+	writeMu sync.Mutex
+
+	mu        sync.Mutex
+	name      string
+	taskTypes []string
+	running   bool
+	restarts  int
+	stdin     io.WriteCloser
+	nextID    int64
+	pending   map[int64]chan pluginResponse
+}
+
+var (
+	plugins   []*plugin
+	pluginsMu sync.Mutex
+)
+
+var errPluginUnavailable = errors.New("plugin unavailable")
+
+// startPlugins launches every configured plugin and registers the task
+// types they declare. Plugins that fail their first handshake abort
+// startup; later failures are retried by the supervisor.
+func startPlugins() error {
+	for _, path := range pluginPaths {
+		p := &plugin{path: path}
+		exited, err := p.start()
+		if err != nil {
+			return fmt.Errorf("plugin %s: %v", path, err)
+		}
+
+		pluginsMu.Lock()
+		plugins = append(plugins, p)
+		pluginsMu.Unlock()
+
+		go p.supervise(exited)
+	}
+	return nil
+}
+
+// start launches the plugin process and waits for its handshake. The
+// returned channel is closed when the process exits.
+func (p *plugin) start() (chan struct{}, error) {
+	cmd := exec.Command(p.path)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			fmt.Printf("Plugin %s: %s\n", p.path, redact(scanner.Text()))
+		}
+	}()
+
+	reader := bufio.NewReader(stdout)
+	handshake := make(chan error, 1)
+	var hs pluginHandshake
+	go func() {
+		line, err := reader.ReadBytes('\n')
+		if err == nil {
+			err = json.Unmarshal(line, &hs)
+		}
+		handshake <- err
+	}()
+
+	select {
+	case err = <-handshake:
+	case <-clock.After(*pluginHandshakeTimeout):
+		err = errors.New("handshake timed out")
+	}
+	if err == nil && hs.Protocol != pluginProtocol {
+		err = fmt.Errorf("unsupported protocol version %d", hs.Protocol)
+	}
+	if err == nil && len(hs.TaskTypes) == 0 {
+		err = errors.New("no task types declared")
+	}
+	for _, taskType := range hs.TaskTypes {
+		if err == nil && builtinTaskTypes[strings.ToLower(taskType)] {
+			err = fmt.Errorf("task type %q is built in", taskType)
+		}
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+
+	p.mu.Lock()
+	previous := p.taskTypes
+	p.name = hs.Name
+	p.taskTypes = hs.TaskTypes
+	p.running = true
+	p.stdin = stdin
+	p.pending = make(map[int64]chan pluginResponse)
+	p.mu.Unlock()
+
+	// A restarted plugin may no longer handle the types it used to.
+	declared := make(map[string]bool)
+	for _, taskType := range hs.TaskTypes {
+		declared[strings.ToLower(taskType)] = true
+		registerTaskHandler(taskType, p.run)
+	}
+	for _, taskType := range previous {
+		if !declared[strings.ToLower(taskType)] {
+			unregisterTaskHandler(taskType)
+		}
+	}
+	fmt.Printf("Plugin %s started, handling %s\n", p.path, strings.Join(hs.TaskTypes, ", "))
+
+	exited := make(chan struct{})
+	go func() {
+		p.readResponses(reader)
+		cmd.Wait()
+		close(exited)
+	}()
+	return exited, nil
+}
+
+func (p *plugin) readResponses(reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+
+		var resp pluginResponse
+		if err := json.Unmarshal(line, &resp); err != nil {
+			fmt.Printf("Plugin %s: invalid response: %v\n", p.path, err)
+			continue
+		}
+
+		p.mu.Lock()
+		ch, ok := p.pending[resp.ID]
+		delete(p.pending, resp.ID)
+		p.mu.Unlock()
+		if ok {
+			ch <- resp
+		}
+	}
+}
+
+// supervise restarts the plugin whenever it exits, backing off up to a
+// minute between failed attempts.
+func (p *plugin) supervise(exited chan struct{}) {
+	backoff := time.Second
+	for {
+		<-exited
+
+		p.mu.Lock()
+		p.running = false
+		p.stdin.Close()
+		for id, ch := range p.pending {
+			ch <- pluginResponse{ID: id, Error: "plugin exited"}
+		}
+		p.pending = nil
+		p.mu.Unlock()
+		fmt.Printf("Plugin %s exited, restarting\n", p.path)
+
+		for {
+			clock.Sleep(backoff)
+
+			var err error
+			exited, err = p.start()
+			if err == nil {
+				break
+			}
+			fmt.Printf("Plugin %s failed to start: %v\n", p.path, err)
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+		}
+
+		p.mu.Lock()
+		p.restarts++
+		p.mu.Unlock()
+		backoff = time.Second
+	}
+}
+
+// run sends a task to the plugin and waits for its response.
+func (p *plugin) run(t Task) error {
+	p.mu.Lock()
+	if !p.running {
+		p.mu.Unlock()
+		return errPluginUnavailable
+	}
+	p.nextID++
+	id := p.nextID
+	ch := make(chan pluginResponse, 1)
+	p.pending[id] = ch
+	stdin := p.stdin
+	p.mu.Unlock()
+
+	line, err := json.Marshal(pluginRequest{ID: id, Task: t})
+	if err == nil {
+		p.writeMu.Lock()
+		_, err = stdin.Write(append(line, '\n'))
+		p.writeMu.Unlock()
+	}
+	if err != nil {
+		p.forget(id)
+		return err
+	}
+
+	timer := clock.NewTimer(*pluginTimeout)
+	defer timer.Stop()
+
+	select {
+	case resp := <-ch:
+		if resp.Error != "" {
+			return errors.New(resp.Error)
+		}
+		if len(resp.Result) > 0 && string(resp.Result) != "null" {
+			addResult(t, resp.Result)
+		}
+		return nil
+	case <-timer.C():
+		p.forget(id)
+		return fmt.Errorf("plugin %s timed out", p.path)
+	}
+}
+
+func (p *plugin) forget(id int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.pending, id)
+}
+
+func pluginsHandler(w http.ResponseWriter, r *http.Request) {
+	type pluginStatus struct {
+		Path      string   `json:"path"`
+		Name      string   `json:"name"`
+		TaskTypes []string `json:"taskTypes"`
+		Running   bool     `json:"running"`
+		Restarts  int      `json:"restarts"`
+		Pending   int      `json:"pending"`
+	}
+
+	pluginsMu.Lock()
+	list := make([]pluginStatus, 0, len(plugins))
+	for _, p := range plugins {
+		p.mu.Lock()
+		list = append(list, pluginStatus{
+			Path:      p.path,
+			Name:      p.name,
+			TaskTypes: p.taskTypes,
+			Running:   p.running,
+			Restarts:  p.restarts,
+			Pending:   len(p.pending),
+		})
+		p.mu.Unlock()
+	}
+	pluginsMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A messageLease hides a received message from other consumers until it is
+// acknowledged or the visibility timeout expires.
+type messageLease struct {
+	receipt string
+	expires time.Time
+}
+
+type ReceivedMessage struct {
+	Message Message `json:"message"`
+	Receipt string  `json:"receipt"`
+}
+
+// Leases are guarded by messagesMu.
+var leases = make(map[int]messageLease)
+
+// randomID returns a random 128-bit hex identifier.
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// leased reports whether the message is currently held by a consumer,
+// dropping its lease if it has expired.
+func leased(id int, now time.Time) bool {
+	l, ok := leases[id]
+	if !ok {
+		return false
+	}
+	if now.After(l.expires) {
+		delete(leases, id)
+		return false
+	}
+	return true
+}
+
+// receiveMessages leases up to max messages of the tenant in ID order.
+// Messages sharing a group key are delivered strictly in order: only the
+// oldest message of a group is eligible, and only while no other message of
+// the group is leased.
+func receiveMessages(tenant string, max int, visibility time.Duration) []ReceivedMessage {
+	messagesMu.Lock()
+	defer messagesMu.Unlock()
+
+	now := clock.Now()
+	ids := make([]int, 0, len(messages))
+	for id := range messages {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	received := []ReceivedMessage{}
+	// blocked holds groups whose head message is leased or already taken.
+	blocked := make(map[string]bool)
+	for _, id := range ids {
+		if len(received) == max {
+			break
+		}
+
+		m := messages[id]
+		if isScheduled(id) || !ownedBy(tenant, m.Tenant) {
+			continue
+		}
+
+		if m.GroupKey != "" {
+			if blocked[m.GroupKey] {
+				continue
+			}
+			blocked[m.GroupKey] = true
+		}
+		if leased(id, now) {
+			continue
+		}
+
+		l := messageLease{receipt: randomID(), expires: now.Add(visibility)}
+		leases[id] = l
+		received = append(received, ReceivedMessage{Message: m, Receipt: l.receipt})
+	}
+	return received
+}
+
+func handleReceive(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	max := 1
+	if v := query.Get("max"); v != "" {
+		var err error
+		max, err = strconv.Atoi(v)
+		if err != nil || max <= 0 {
+			http.Error(w, "Invalid max parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	visibility := 30 * time.Second
+	if v := query.Get("visibility"); v != "" {
+		var err error
+		visibility, err = time.ParseDuration(v)
+		if err != nil || visibility <= 0 {
+			http.Error(w, "Invalid visibility parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receiveMessages(requestTenant(r), max, visibility))
+}
+
+// handleAck deletes a received message, which releases its group so the
+// next message in the group can be delivered.
+func handleAck(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		ID      int    `json:"id"`
+		Receipt string `json:"receipt"`
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.Unmarshal(body, &request); err != nil {
+		http.Error(w, "Error parsing request body", http.StatusBadRequest)
+		return
+	}
+
+	messagesMu.Lock()
+	defer messagesMu.Unlock()
+
+	l, ok := leases[request.ID]
+	if !ok || l.receipt != request.Receipt || clock.Now().After(l.expires) {
+		http.Error(w, "Invalid or expired receipt", http.StatusConflict)
+		return
+	}
+
+	removeMessage(messages[request.ID])
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,8 @@
+#!/bin/bash
+
+# Example task plugin, start the server with: go run . -plugin requests/echo-plugin.sh
+echo '{"protocol":1,"name":"echo","taskTypes":["echo"]}'
+while read -r line; do
+  id=$(echo "$line" | sed 's/^{"id":\([0-9]*\).*/\1/')
+  echo "{\"id\":$id,\"result\":$line}"
+done
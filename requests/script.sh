@@ -0,0 +1,4 @@
+#/bin/bash
+
+curl -X POST -d '{"task":{"id":1,"task":"Script","script":"r = http.get(\"http://localhost:3000\")\nassert(r.status == 200, \"unexpected status\")\nemit({\"status\": r.status, \"size\": len(r.body)})\n"},"count":10}' localhost:8080/run/
+curl localhost:8080/results/1
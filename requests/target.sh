@@ -0,0 +1,5 @@
+#/bin/bash
+
+# Start the mock target first with: go run . target -addr :3000
+curl -X PUT -d '{"default":{"latency":{"distribution":"normal","meanMs":50,"stddevMs":10},"statuses":[{"code":200,"weight":9},{"code":503,"weight":1}],"errorRate":0.01,"payloadSize":1024}}' localhost:3000/_target/config
+curl localhost:3000/_target/stats
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScenarioStep is one HTTP request of a scenario task. URL, headers and
+// body may reference variables extracted by earlier steps as {{name}}.
+type ScenarioStep struct {
+	Name    string            `json:"name"`
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	Extract []Extraction      `json:"extract,omitempty"`
+	// Credentials overrides the credential profile of the task.
+	Credentials string `json:"credentials,omitempty"`
+	// ExpectStatus, ExpectBody and MaxDurationMs are assertions on the
+	// response; zero values are not checked.
+	ExpectStatus  int    `json:"expectStatus,omitempty"`
+	ExpectBody    string `json:"expectBody,omitempty"`
+	MaxDurationMs int    `json:"maxDurationMs,omitempty"`
+}
+
+// Extraction stores a value from a response in a variable. Exactly one of
+// JSONPath ("data.items.0.id"), Regex (first capture group) or Header is
+// used.
+type Extraction struct {
+	Var      string `json:"var"`
+	JSONPath string `json:"jsonPath,omitempty"`
+	Regex    string `json:"regex,omitempty"`
+	Header   string `json:"header,omitempty"`
+}
+
+type StepResult struct {
+	Name       string  `json:"name"`
+	Status     int     `json:"status,omitempty"`
+	DurationMs float64 `json:"durationMs"`
+	Error      string  `json:"error,omitempty"`
+}
+
+var scenarioMaxBody = flag.Int64("scenario-max-body", 1<<20, "maximum size in bytes of an HTTP response read by a scenario step")
+
+var variablePattern = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_]+)\s*\}\}`)
+
+// renderTemplate resolves the secret references of a step template and
+// then expands its variables. Secrets are resolved first because variables
+// hold text from responses, which must not be able to pull secrets into
+// later requests.
+func renderTemplate(s string, vars map[string]string) (string, error) {
+	s, err := resolveSecrets(s)
+	if err != nil {
+		return "", err
+	}
+	return expandVariables(s, vars), nil
+}
+
+func expandVariables(s string, vars map[string]string) string {
+	return variablePattern.ReplaceAllStringFunc(s, func(match string) string {
+		name := variablePattern.FindStringSubmatch(match)[1]
+		if v, ok := vars[name]; ok {
+			return v
+		}
+		return match
+	})
+}
+
+// scenarioTask runs the steps of a task in order with a shared cookie jar
+// and variables, stopping at the first failed step. The timing of every
+// step is recorded as the task result.
+func scenarioTask(t Task) error {
+	if len(t.Steps) == 0 {
+		return errors.New("scenario task without steps")
+	}
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	vars := make(map[string]string)
+
+	var results []StepResult
+	var err error
+	for i, step := range t.Steps {
+		if step.Name == "" {
+			step.Name = strconv.Itoa(i + 1)
+		}
+
+		if step.Credentials == "" {
+			step.Credentials = t.Credentials
+		}
+
+		var result StepResult
+		result, err = runStep(client, step, vars)
+		results = append(results, result)
+		if err != nil {
+			err = fmt.Errorf("step %s: %v", step.Name, err)
+			break
+		}
+	}
+
+	if data, merr := json.Marshal(map[string][]StepResult{"steps": results}); merr == nil {
+		addResult(t, data)
+	}
+	return err
+}
+
+func runStep(client *http.Client, step ScenarioStep, vars map[string]string) (StepResult, error) {
+	result := StepResult{Name: step.Name}
+
+	method := step.Method
+	if method == "" {
+		method = "GET"
+	}
+	url, err := renderTemplate(step.URL, vars)
+	if err != nil {
+		result.Error = err.Error()
+		return result, err
+	}
+	body, err := renderTemplate(step.Body, vars)
+	if err != nil {
+		result.Error = err.Error()
+		return result, err
+	}
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		result.Error = err.Error()
+		return result, err
+	}
+	for k, v := range step.Headers {
+		v, err := renderTemplate(v, vars)
+		if err != nil {
+			result.Error = err.Error()
+			return result, err
+		}
+		req.Header.Set(k, v)
+	}
+
+	start := clock.Now()
+	resp, err := doWithCredentials(client, req, step.Credentials)
+	if err == nil {
+		var respBody []byte
+		respBody, err = io.ReadAll(io.LimitReader(resp.Body, *scenarioMaxBody+1))
+		resp.Body.Close()
+		result.Status = resp.StatusCode
+		if err == nil && int64(len(respBody)) > *scenarioMaxBody {
+			err = fmt.Errorf("response body exceeds %d bytes", *scenarioMaxBody)
+		}
+		if err == nil {
+			err = checkStep(step, resp, respBody, clock.Now().Sub(start), vars)
+		}
+	}
+	result.DurationMs = float64(clock.Now().Sub(start)) / float64(time.Millisecond)
+
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result, err
+}
+
+// checkStep applies the step's assertions and extracts its variables.
+func checkStep(step ScenarioStep, resp *http.Response, body []byte, elapsed time.Duration, vars map[string]string) error {
+	if step.ExpectStatus != 0 && resp.StatusCode != step.ExpectStatus {
+		return fmt.Errorf("expected status %d, got %d", step.ExpectStatus, resp.StatusCode)
+	}
+	if step.ExpectStatus == 0 && resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if step.ExpectBody != "" && !strings.Contains(string(body), expandVariables(step.ExpectBody, vars)) {
+		return fmt.Errorf("body does not contain %q", step.ExpectBody)
+	}
+	if step.MaxDurationMs > 0 && elapsed > time.Duration(step.MaxDurationMs)*time.Millisecond {
+		return fmt.Errorf("took %v, more than %dms", elapsed, step.MaxDurationMs)
+	}
+
+	for _, e := range step.Extract {
+		value, err := extract(e, resp, body)
+		if err != nil {
+			return fmt.Errorf("extracting %s: %v", e.Var, err)
+		}
+		vars[e.Var] = value
+	}
+	return nil
+}
+
+func extract(e Extraction, resp *http.Response, body []byte) (string, error) {
+	switch {
+	case e.Header != "":
+		v := resp.Header.Get(e.Header)
+		if v == "" {
+			return "", fmt.Errorf("header %s not found", e.Header)
+		}
+		return v, nil
+	case e.Regex != "":
+		re, err := regexp.Compile(e.Regex)
+		if err != nil {
+			return "", err
+		}
+		match := re.FindSubmatch(body)
+		if match == nil {
+			return "", errors.New("no match")
+		}
+		if len(match) > 1 {
+			return string(match[1]), nil
+		}
+		return string(match[0]), nil
+	case e.JSONPath != "":
+		var doc interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return "", err
+		}
+		return lookupJSONPath(doc, e.JSONPath)
+	}
+	return "", errors.New("no extraction source")
+}
+
+// lookupJSONPath follows a dot-separated path of object keys and array
+// indexes, with an optional leading "$.".
+func lookupJSONPath(doc interface{}, path string) (string, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	for _, key := range strings.Split(path, ".") {
+		if key == "" {
+			continue
+		}
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			next, ok := v[key]
+			if !ok {
+				return "", fmt.Errorf("key %q not found", key)
+			}
+			doc = next
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return "", fmt.Errorf("invalid index %q", key)
+			}
+			doc = v[i]
+		default:
+			return "", fmt.Errorf("cannot descend into %q", key)
+		}
+	}
+
+	if s, ok := doc.(string); ok {
+		return s, nil
+	}
+	data, err := json.Marshal(doc)
+	return string(data), err
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+type scheduledMessage struct {
+	id int
+	at time.Time
+}
+
+// scheduleHeap is a min-heap of pending deliveries ordered by time.
+type scheduleHeap []scheduledMessage
+
+func (h scheduleHeap) Len() int            { return len(h) }
+func (h scheduleHeap) Less(i, j int) bool  { return h[i].at.Before(h[j].at) }
+func (h scheduleHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *scheduleHeap) Push(x interface{}) { *h = append(*h, x.(scheduledMessage)) }
+func (h *scheduleHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// The schedule is guarded by messagesMu. scheduled holds the messages that
+// are still hidden; heap entries that no longer match it are stale and are
+// skipped when popped.
+var (
+	schedule     scheduleHeap
+	scheduled    = make(map[int]time.Time)
+	scheduleWake = make(chan struct{}, 1)
+)
+
+// scheduleMessage hides the message until its delivery time. The caller
+// must hold messagesMu.
+func scheduleMessage(m Message) {
+	if m.DeliverAt == nil || !m.DeliverAt.After(clock.Now()) {
+		delete(scheduled, m.ID)
+		return
+	}
+
+	scheduled[m.ID] = *m.DeliverAt
+	heap.Push(&schedule, scheduledMessage{id: m.ID, at: *m.DeliverAt})
+	if schedule[0].id == m.ID {
+		select {
+		case scheduleWake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// isScheduled reports whether the message is still hidden. The caller must
+// hold messagesMu.
+func isScheduled(id int) bool {
+	_, ok := scheduled[id]
+	return ok
+}
+
+// scheduler makes messages visible as their delivery time passes, which
+// is when their create event is recorded.
+func scheduler() {
+	for {
+		messagesMu.Lock()
+		now := clock.Now()
+		for len(schedule) > 0 && !schedule[0].at.After(now) {
+			e := heap.Pop(&schedule).(scheduledMessage)
+			if at, ok := scheduled[e.id]; ok && at.Equal(e.at) {
+				delete(scheduled, e.id)
+				recordChange("create", messages[e.id])
+				fmt.Printf("Message delivered: %d\n", e.id)
+			}
+		}
+		wait := time.Hour
+		if len(schedule) > 0 {
+			wait = schedule[0].at.Sub(now)
+		}
+		messagesMu.Unlock()
+
+		timer := clock.NewTimer(wait)
+		select {
+		case <-timer.C():
+		case <-scheduleWake:
+		}
+		timer.Stop()
+	}
+}
+
+func handleScheduledMessages(w http.ResponseWriter, r *http.Request) {
+	tenant := requestTenant(r)
+
+	messagesMu.Lock()
+	list := make([]Message, 0, len(scheduled))
+	for id := range scheduled {
+		if m := messages[id]; ownedBy(tenant, m.Tenant) {
+			list = append(list, m)
+		}
+	}
+	messagesMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].DeliverAt.Equal(*list[j].DeliverAt) {
+			return list[i].DeliverAt.Before(*list[j].DeliverAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	scriptTimeout  = flag.Duration("script-timeout", 30*time.Second, "maximum run time of a script task")
+	scriptMaxSteps = flag.Uint64("script-max-steps", 10000000, "maximum number of execution steps of a script task")
+	scriptMaxBody  = flag.Int64("script-max-body", 1<<20, "maximum size in bytes of an HTTP response read by a script")
+	scriptMaxEmits = flag.Int("script-max-emits", 100, "maximum number of results a script task may emit")
+	// Starlark cannot bound what a script allocates, so scripts run in a
+	// child process whose memory the operating system limits.
+	scriptMaxMemory = flag.Int64("script-max-memory", 256<<20, "maximum memory in bytes of the process running a script task; 0 for no limit")
+)
+
+// Results emitted by tasks, keyed by tenant and task ID. Tasks queued
+// together share an ID, so their results are collected in one list.
+var (
+	results   = make(map[resultsKey][]json.RawMessage)
+	resultsMu sync.Mutex
+)
+
+type resultsKey struct {
+	tenant string
+	taskID int
+}
+
+const maxResultsPerTask = 10000
+
+func addResult(t Task, result json.RawMessage) {
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+
+	key := resultsKey{t.Tenant, t.ID}
+	if len(results[key]) < maxResultsPerTask {
+		results[key] = append(results[key], redactJSON(result))
+	}
+}
+
+func resultsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.URL.Path[len("/results/"):])
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+
+	// Callers that are not confined to a tenant may name one.
+	tenant := requestTenant(r)
+	if tenant == "" {
+		tenant = r.URL.Query().Get("tenant")
+	}
+
+	resultsMu.Lock()
+	list, ok := results[resultsKey{tenant, id}]
+	resultsMu.Unlock()
+	if !ok {
+		http.Error(w, "Results not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// scriptRun holds the state of a single script execution.
+type scriptRun struct {
+	ctx   context.Context
+	task  Task
+	emits int
+}
+
+// scriptTask runs the task's Starlark script in a script process. Scripts
+// can only reach the outside world through the predeclared builtins,
+// which the process asks the server to carry out. CPU use is bounded by
+// the step limit, run time by the timeout and memory by the limit on the
+// process, so a runaway script fails its task instead of the server.
+func scriptTask(t Task) error {
+	if t.Script == "" {
+		return errors.New("script task without a script")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stderr := &scriptStderr{}
+	cmd := exec.CommandContext(ctx, exe, "script", "-max-memory", strconv.FormatInt(*scriptMaxMemory, 10))
+	cmd.Stderr = stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	timedOut := make(chan struct{})
+	timer := clock.NewTimer(*scriptTimeout)
+	defer timer.Stop()
+	go func() {
+		select {
+		case <-timer.C():
+			close(timedOut)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	run := &scriptRun{ctx: ctx, task: t}
+	enc := json.NewEncoder(stdin)
+	enc.Encode(scriptStart{TaskID: t.ID, Script: t.Script, MaxSteps: *scriptMaxSteps})
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64<<10), scriptCallLimit())
+	finished := false
+	var scriptErr error
+	for !finished && scanner.Scan() {
+		var c scriptCall
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			break
+		}
+		switch c.Call {
+		case "done":
+			finished = true
+			if c.Error != "" {
+				scriptErr = errors.New(c.Error)
+			}
+		case "print":
+			fmt.Printf("Task %d: %s\n", t.ID, redact(c.Text))
+		default:
+			enc.Encode(run.handle(c))
+		}
+	}
+	if !finished {
+		cancel()
+	}
+	waitErr := cmd.Wait()
+
+	select {
+	case <-timedOut:
+		return errors.New("script timed out")
+	default:
+	}
+	switch {
+	case finished:
+		return scriptErr
+	case scanner.Err() == bufio.ErrTooLong:
+		return fmt.Errorf("script call exceeds %d bytes", scriptCallLimit())
+	case stderr.outOfMemory():
+		return fmt.Errorf("script exceeded the memory limit of %d bytes", *scriptMaxMemory)
+	case stderr.first != "":
+		return fmt.Errorf("script process failed: %s", redact(stderr.first))
+	}
+	return fmt.Errorf("script process failed: %v", waitErr)
+}
+
+// scriptCallLimit bounds the lines a script process writes, which carry
+// request bodies, messages and results.
+func scriptCallLimit() int {
+	n := *scriptMaxBody
+	if *maxMessageSize > n {
+		n = *maxMessageSize
+	}
+	// Bodies are base64 encoded.
+	return int(2*n + 64<<10)
+}
+
+// scriptStderr keeps the first line a script process writes to stderr,
+// which explains why it crashed, and drops the stack traces after it.
+type scriptStderr struct {
+	line  []byte
+	first string
+	done  bool
+}
+
+// outOfMemory reports whether the process crashed for lack of memory, as
+// told by the Go runtime or, in race-enabled builds, the race detector.
+func (s *scriptStderr) outOfMemory() bool {
+	return strings.Contains(s.first, "out of memory") || strings.Contains(s.first, "allocate")
+}
+
+func (s *scriptStderr) Write(p []byte) (int, error) {
+	if s.done {
+		return len(p), nil
+	}
+	if i := bytes.IndexByte(p, '\n'); i >= 0 {
+		s.first = string(append(s.line, p[:i]...))
+		s.done = true
+	} else if len(s.line) < 4096 {
+		s.line = append(s.line, p...)
+	}
+	return len(p), nil
+}
+
+// handle carries out a builtin call of a script.
+func (run *scriptRun) handle(c scriptCall) scriptReply {
+	var reply scriptReply
+	var err error
+	switch c.Call {
+	case "http":
+		reply, err = run.do(c.Method, c.URL, c.Body, c.Headers)
+	case "sleep":
+		err = run.sleep(c.Seconds)
+	case "emit":
+		err = run.emit(c.Value)
+	case "publish":
+		reply.ID, err = run.publish(c.Message, c.Attributes, c.GroupKey)
+	default:
+		err = fmt.Errorf("unknown call %q", c.Call)
+	}
+	if err != nil {
+		return scriptReply{Error: err.Error()}
+	}
+	return reply
+}
+
+// do performs an HTTP request for a script.
+// Secret references in the URL, body and headers are resolved here, so
+// scripts can use secrets without holding them. A script can still read a
+// secret from a target that echoes it back and transform it past redact,
+// so scripts using secrets must be trusted with them.
+func (run *scriptRun) do(method, url string, body []byte, headers map[string]string) (scriptReply, error) {
+	url, err := resolveSecrets(url)
+	if err != nil {
+		return scriptReply{}, err
+	}
+	resolved, err := resolveSecrets(string(body))
+	if err != nil {
+		return scriptReply{}, err
+	}
+	req, err := http.NewRequestWithContext(run.ctx, method, url, strings.NewReader(resolved))
+	if err != nil {
+		return scriptReply{}, err
+	}
+	for k, v := range headers {
+		v, err := resolveSecrets(v)
+		if err != nil {
+			return scriptReply{}, err
+		}
+		req.Header.Set(k, v)
+	}
+
+	resp, err := doWithCredentials(http.DefaultClient, req, run.task.Credentials)
+	if err != nil {
+		return scriptReply{}, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, *scriptMaxBody+1))
+	if err != nil {
+		return scriptReply{}, err
+	}
+	if int64(len(data)) > *scriptMaxBody {
+		return scriptReply{}, fmt.Errorf("response body exceeds %d bytes", *scriptMaxBody)
+	}
+
+	reply := scriptReply{Status: resp.StatusCode, Body: data, Headers: make(map[string]string, len(resp.Header))}
+	for k := range resp.Header {
+		reply.Headers[k] = resp.Header.Get(k)
+	}
+	return reply, nil
+}
+
+func (run *scriptRun) sleep(seconds float64) error {
+	timer := clock.NewTimer(time.Duration(seconds * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return nil
+	case <-run.ctx.Done():
+		return errors.New("script timed out")
+	}
+}
+
+func (run *scriptRun) emit(value json.RawMessage) error {
+	if run.emits >= *scriptMaxEmits {
+		return fmt.Errorf("emit: more than %d results", *scriptMaxEmits)
+	}
+	run.emits++
+	addResult(run.task, value)
+	return nil
+}
+
+func (run *scriptRun) publish(message string, attributes map[string]string, groupKey string) (int, error) {
+	m := Message{Message: redact(message), Attributes: attributes, GroupKey: groupKey, Tenant: run.task.Tenant}
+	for k, v := range m.Attributes {
+		m.Attributes[k] = redact(v)
+	}
+	if err := validateMessage(&m); err != nil {
+		return 0, err
+	}
+	m, err := createMessage(m)
+	if err != nil {
+		return 0, err
+	}
+	return m.ID, nil
+}
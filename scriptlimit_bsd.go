@@ -0,0 +1,11 @@
+//go:build freebsd || dragonfly
+
+package main
+
+import "syscall"
+
+// limitMemory caps the data segment of the process, which holds the Go
+// heap. Unlike other systems, these use signed limits.
+func limitMemory(bytes int64) error {
+	return syscall.Setrlimit(syscall.RLIMIT_DATA, &syscall.Rlimit{Cur: bytes, Max: bytes})
+}
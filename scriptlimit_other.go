@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+func limitMemory(bytes int64) error {
+	return errors.New("memory limits are not supported on this platform; run with -script-max-memory=0")
+}
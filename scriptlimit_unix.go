@@ -0,0 +1,11 @@
+//go:build unix && !freebsd && !dragonfly
+
+package main
+
+import "syscall"
+
+// limitMemory caps the data segment of the process, which holds the Go
+// heap, so that allocating beyond it fails.
+func limitMemory(bytes int64) error {
+	return syscall.Setrlimit(syscall.RLIMIT_DATA, &syscall.Rlimit{Cur: uint64(bytes), Max: uint64(bytes)})
+}
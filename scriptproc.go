@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+	"strings"
+
+	starlarkjson "go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// A script process runs one Starlark script under a memory limit. It is
+// the server binary started with the script subcommand, and talks to the
+// server in newline-delimited JSON over stdin and stdout: the server
+// writes a scriptStart, after which the process writes a scriptCall for
+// every builtin call, answered with a scriptReply, and finally a done
+// call with the outcome of the script.
+
+type scriptStart struct {
+	TaskID   int    `json:"taskId"`
+	Script   string `json:"script"`
+	MaxSteps uint64 `json:"maxSteps"`
+}
+
+// scriptCall is one of http, sleep, emit and publish, which are answered,
+// or print and done, which are not.
+type scriptCall struct {
+	Call       string            `json:"call"`
+	Method     string            `json:"method,omitempty"`
+	URL        string            `json:"url,omitempty"`
+	Body       []byte            `json:"body,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Seconds    float64           `json:"seconds,omitempty"`
+	Value      json.RawMessage   `json:"value,omitempty"`
+	Message    string            `json:"message,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	GroupKey   string            `json:"groupKey,omitempty"`
+	Text       string            `json:"text,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+type scriptReply struct {
+	Error   string            `json:"error,omitempty"`
+	Status  int               `json:"status,omitempty"`
+	Body    []byte            `json:"body,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	ID      int               `json:"id,omitempty"`
+}
+
+type scriptProcess struct {
+	in  *bufio.Reader
+	out *json.Encoder
+}
+
+func runScriptProcess(args []string) {
+	fs := flag.NewFlagSet("script", flag.ExitOnError)
+	maxMemory := fs.Int64("max-memory", 0, "maximum memory in bytes; 0 for no limit")
+	fs.Parse(args)
+
+	if *maxMemory > 0 {
+		if err := limitMemory(*maxMemory); err != nil {
+			log.Fatalf("Error limiting memory: %v", err)
+		}
+		// Collect garbage before the hard limit is reached.
+		debug.SetMemoryLimit(*maxMemory / 4 * 3)
+	}
+
+	p := &scriptProcess{in: bufio.NewReader(os.Stdin), out: json.NewEncoder(os.Stdout)}
+	line, err := p.in.ReadBytes('\n')
+	if err != nil {
+		log.Fatalf("Error reading script: %v", err)
+	}
+	var start scriptStart
+	if err := json.Unmarshal(line, &start); err != nil {
+		log.Fatalf("Error parsing script: %v", err)
+	}
+
+	thread := &starlark.Thread{
+		Name:  fmt.Sprintf("task-%d", start.TaskID),
+		Print: func(_ *starlark.Thread, msg string) { p.out.Encode(scriptCall{Call: "print", Text: msg}) },
+	}
+	thread.SetMaxExecutionSteps(start.MaxSteps)
+
+	predeclared := starlark.StringDict{
+		"http": &starlarkstruct.Module{
+			Name: "http",
+			Members: starlark.StringDict{
+				"get":     starlark.NewBuiltin("http.get", p.httpGet),
+				"post":    starlark.NewBuiltin("http.post", p.httpPost),
+				"request": starlark.NewBuiltin("http.request", p.httpRequest),
+			},
+		},
+		"json":    starlarkjson.Module,
+		"sleep":   starlark.NewBuiltin("sleep", p.sleep),
+		"assert":  starlark.NewBuiltin("assert", scriptAssert),
+		"emit":    starlark.NewBuiltin("emit", p.emit),
+		"publish": starlark.NewBuiltin("publish", p.publish),
+	}
+
+	done := scriptCall{Call: "done"}
+	opts := &syntax.FileOptions{While: true, TopLevelControl: true, Set: true}
+	_, err = starlark.ExecFileOptions(opts, thread, fmt.Sprintf("task-%d.star", start.TaskID), start.Script, predeclared)
+	if evalErr, ok := err.(*starlark.EvalError); ok {
+		done.Error = evalErr.Backtrace()
+	} else if err != nil {
+		done.Error = err.Error()
+	}
+	p.out.Encode(done)
+}
+
+// call asks the server to carry out a builtin call and waits for the
+// reply.
+func (p *scriptProcess) call(c scriptCall) (scriptReply, error) {
+	if err := p.out.Encode(c); err != nil {
+		return scriptReply{}, err
+	}
+	line, err := p.in.ReadBytes('\n')
+	if err != nil {
+		return scriptReply{}, err
+	}
+	var reply scriptReply
+	if err := json.Unmarshal(line, &reply); err != nil {
+		return scriptReply{}, err
+	}
+	if reply.Error != "" {
+		return reply, errors.New(reply.Error)
+	}
+	return reply, nil
+}
+
+func (p *scriptProcess) httpGet(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var url string
+	var headers *starlark.Dict
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "url", &url, "headers?", &headers); err != nil {
+		return nil, err
+	}
+	return p.do("GET", url, "", headers)
+}
+
+func (p *scriptProcess) httpPost(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var url, body string
+	var headers *starlark.Dict
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "url", &url, "body?", &body, "headers?", &headers); err != nil {
+		return nil, err
+	}
+	return p.do("POST", url, body, headers)
+}
+
+func (p *scriptProcess) httpRequest(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var method, url, body string
+	var headers *starlark.Dict
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "method", &method, "url", &url, "body?", &body, "headers?", &headers); err != nil {
+		return nil, err
+	}
+	return p.do(strings.ToUpper(method), url, body, headers)
+}
+
+// do has the server perform an HTTP request and returns a struct with the
+// status, body and headers of the response.
+func (p *scriptProcess) do(method, url, body string, headers *starlark.Dict) (starlark.Value, error) {
+	c := scriptCall{Call: "http", Method: method, URL: url, Body: []byte(body)}
+	if headers != nil {
+		c.Headers = make(map[string]string, headers.Len())
+		for _, item := range headers.Items() {
+			k, ok1 := starlark.AsString(item[0])
+			v, ok2 := starlark.AsString(item[1])
+			if !ok1 || !ok2 {
+				return nil, errors.New("headers must map strings to strings")
+			}
+			c.Headers[k] = v
+		}
+	}
+
+	reply, err := p.call(c)
+	if err != nil {
+		return nil, err
+	}
+
+	respHeaders := starlark.NewDict(len(reply.Headers))
+	for k, v := range reply.Headers {
+		respHeaders.SetKey(starlark.String(k), starlark.String(v))
+	}
+	return starlarkstruct.FromStringDict(starlark.String("response"), starlark.StringDict{
+		"status":  starlark.MakeInt(reply.Status),
+		"body":    starlark.String(reply.Body),
+		"headers": respHeaders,
+	}), nil
+}
+
+func (p *scriptProcess) sleep(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var seconds starlark.Value
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &seconds); err != nil {
+		return nil, err
+	}
+	f, ok := starlark.AsFloat(seconds)
+	if !ok || f < 0 {
+		return nil, fmt.Errorf("%s: invalid duration %s", b.Name(), seconds)
+	}
+
+	if _, err := p.call(scriptCall{Call: "sleep", Seconds: f}); err != nil {
+		return nil, err
+	}
+	return starlark.None, nil
+}
+
+func scriptAssert(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var cond starlark.Value
+	msg := "assertion failed"
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "cond", &cond, "msg?", &msg); err != nil {
+		return nil, err
+	}
+	if !cond.Truth() {
+		return nil, errors.New(msg)
+	}
+	return starlark.None, nil
+}
+
+func (p *scriptProcess) emit(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	encoded, err := starlark.Call(thread, starlarkjson.Module.Members["encode"], args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.call(scriptCall{Call: "emit", Value: json.RawMessage(encoded.(starlark.String))}); err != nil {
+		return nil, err
+	}
+	return starlark.None, nil
+}
+
+func (p *scriptProcess) publish(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	c := scriptCall{Call: "publish"}
+	var attributes *starlark.Dict
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "message", &c.Message, "attributes?", &attributes, "group_key?", &c.GroupKey); err != nil {
+		return nil, err
+	}
+	if attributes != nil {
+		c.Attributes = make(map[string]string, attributes.Len())
+		for _, item := range attributes.Items() {
+			k, ok1 := starlark.AsString(item[0])
+			v, ok2 := starlark.AsString(item[1])
+			if !ok1 || !ok2 {
+				return nil, errors.New("attributes must map strings to strings")
+			}
+			c.Attributes[k] = v
+		}
+	}
+
+	reply, err := p.call(c)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.MakeInt(reply.ID), nil
+}
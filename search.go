@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// The search index is guarded by messagesMu, like the messages map it
+// mirrors, so the two can never drift apart.
+var searchIndex = newInvertedIndex()
+
+type invertedIndex struct {
+	// postings maps a term to the positions it occurs at in each message.
+	postings map[string]map[int][]int
+	// lengths holds the number of terms indexed for each message.
+	lengths map[int]int
+}
+
+type token struct {
+	term       string
+	start, end int
+}
+
+type SearchResult struct {
+	Message   Message `json:"message"`
+	Score     float64 `json:"score"`
+	Highlight string  `json:"highlight"`
+}
+
+func newInvertedIndex() *invertedIndex {
+	return &invertedIndex{
+		postings: make(map[string]map[int][]int),
+		lengths:  make(map[int]int),
+	}
+}
+
+func tokenize(text string) []token {
+	var tokens []token
+	start := -1
+	for i, c := range text {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			tokens = append(tokens, token{strings.ToLower(text[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{strings.ToLower(text[start:]), start, len(text)})
+	}
+	return tokens
+}
+
+// searchableText returns the text of a message that is indexed: the message
+// itself and any textual payload.
+func searchableText(m Message) string {
+	text := m.Message
+	if m.Data != nil && strings.HasPrefix(m.ContentType, "text/") {
+		text += "\n" + string(m.Data)
+	}
+	return text
+}
+
+func (idx *invertedIndex) add(m Message) {
+	tokens := tokenize(searchableText(m))
+	for pos, t := range tokens {
+		docs, ok := idx.postings[t.term]
+		if !ok {
+			docs = make(map[int][]int)
+			idx.postings[t.term] = docs
+		}
+		docs[m.ID] = append(docs[m.ID], pos)
+	}
+	idx.lengths[m.ID] = len(tokens)
+}
+
+func (idx *invertedIndex) remove(m Message) {
+	for _, t := range tokenize(searchableText(m)) {
+		docs, ok := idx.postings[t.term]
+		if !ok {
+			continue
+		}
+		delete(docs, m.ID)
+		if len(docs) == 0 {
+			delete(idx.postings, t.term)
+		}
+	}
+	delete(idx.lengths, m.ID)
+}
+
+// rebuildIndex recreates the search index from the messages map.
+func rebuildIndex() {
+	messagesMu.Lock()
+	defer messagesMu.Unlock()
+
+	searchIndex = newInvertedIndex()
+	for _, m := range messages {
+		searchIndex.add(m)
+	}
+}
+
+// A query clause is a single term, a prefix ("fetch*") or a quoted phrase.
+// A message matches a query when it matches every clause.
+type queryClause struct {
+	terms  []string
+	prefix bool
+}
+
+func parseQuery(q string) []queryClause {
+	var clauses []queryClause
+	for len(q) > 0 {
+		q = strings.TrimLeft(q, " \t")
+		if q == "" {
+			break
+		}
+
+		if q[0] == '"' {
+			end := strings.IndexByte(q[1:], '"')
+			var phrase string
+			if end < 0 {
+				phrase, q = q[1:], ""
+			} else {
+				phrase, q = q[1:end+1], q[end+2:]
+			}
+			var terms []string
+			for _, t := range tokenize(phrase) {
+				terms = append(terms, t.term)
+			}
+			if len(terms) > 0 {
+				clauses = append(clauses, queryClause{terms: terms})
+			}
+			continue
+		}
+
+		end := strings.IndexAny(q, " \t")
+		if end < 0 {
+			end = len(q)
+		}
+		word := q[:end]
+		q = q[end:]
+
+		prefix := strings.HasSuffix(word, "*")
+		tokens := tokenize(word)
+		for i, t := range tokens {
+			clauses = append(clauses, queryClause{terms: []string{t.term}, prefix: prefix && i == len(tokens)-1})
+		}
+	}
+	return clauses
+}
+
+// match returns the score of each message matching the clause, along with
+// the terms that matched so they can be highlighted.
+func (idx *invertedIndex) match(c queryClause) (map[int]float64, []string) {
+	scores := make(map[int]float64)
+	total := float64(len(idx.lengths))
+
+	if c.prefix {
+		var matched []string
+		for term, docs := range idx.postings {
+			if !strings.HasPrefix(term, c.terms[0]) {
+				continue
+			}
+			matched = append(matched, term)
+			idf := math.Log(1 + total/float64(len(docs)))
+			for id, positions := range docs {
+				scores[id] += float64(len(positions)) / float64(idx.lengths[id]) * idf
+			}
+		}
+		return scores, matched
+	}
+
+	first, ok := idx.postings[c.terms[0]]
+	if !ok {
+		return scores, nil
+	}
+	for id, positions := range first {
+		count := 0
+		for _, pos := range positions {
+			if idx.phraseAt(id, c.terms, pos) {
+				count++
+			}
+		}
+		if count == 0 {
+			continue
+		}
+
+		var score float64
+		for _, term := range c.terms {
+			idf := math.Log(1 + total/float64(len(idx.postings[term])))
+			score += float64(count) / float64(idx.lengths[id]) * idf
+		}
+		scores[id] = score
+	}
+	return scores, c.terms
+}
+
+func (idx *invertedIndex) phraseAt(id int, terms []string, pos int) bool {
+	for i, term := range terms[1:] {
+		found := false
+		for _, p := range idx.postings[term][id] {
+			if p == pos+i+1 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (idx *invertedIndex) search(clauses []queryClause) ([]SearchResult, []string) {
+	var scores map[int]float64
+	var highlightTerms []string
+
+	for _, c := range clauses {
+		matched, terms := idx.match(c)
+		highlightTerms = append(highlightTerms, terms...)
+		if scores == nil {
+			scores = matched
+			continue
+		}
+		for id := range scores {
+			if s, ok := matched[id]; ok {
+				scores[id] += s
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	results := make([]SearchResult, 0, len(scores))
+	for id, score := range scores {
+		if isScheduled(id) {
+			continue
+		}
+		results = append(results, SearchResult{Message: messages[id], Score: score})
+	}
+	return results, highlightTerms
+}
+
+// highlight wraps every occurrence of the given terms in <em> tags,
+// escaping the text around them as HTML.
+func highlight(text string, terms []string) string {
+	set := make(map[string]bool, len(terms))
+	for _, t := range terms {
+		set[t] = true
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, t := range tokenize(text) {
+		if !set[t.term] {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[last:t.start]))
+		b.WriteString("<em>")
+		b.WriteString(html.EscapeString(text[t.start:t.end]))
+		b.WriteString("</em>")
+		last = t.end
+	}
+	b.WriteString(html.EscapeString(text[last:]))
+	return b.String()
+}
+
+func handleSearchMessages(w http.ResponseWriter, r *http.Request) {
+	clauses := parseQuery(r.URL.Query().Get("q"))
+	if len(clauses) == 0 {
+		http.Error(w, "Missing search query", http.StatusBadRequest)
+		return
+	}
+
+	messagesMu.Lock()
+	matches, terms := searchIndex.search(clauses)
+	messagesMu.Unlock()
+
+	tenant := requestTenant(r)
+	results := make([]SearchResult, 0, len(matches))
+	for _, result := range matches {
+		if ownedBy(tenant, result.Message.Tenant) {
+			results = append(results, result)
+		}
+	}
+
+	for i := range results {
+		results[i].Highlight = highlight(searchableText(results[i].Message), terms)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Message.ID < results[j].Message.ID
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
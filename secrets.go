@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secrets are stored in a file encrypted with AES-256-GCM under a master
+// key read from the environment or a key file, and decrypted into memory
+// at startup. Tasks and credential profiles reference them as
+// ${secret:name}; references are resolved only when a request is made so
+// the values never appear in stored tasks, and every known value is
+// redacted from logs and results.
+
+type encryptedSecret struct {
+	Version    int       `json:"version"`
+	Nonce      []byte    `json:"nonce"`
+	Ciphertext []byte    `json:"ciphertext"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+type SecretInfo struct {
+	Name      string    `json:"name"`
+	Version   int       `json:"version"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+var (
+	secretsFile           = flag.String("secrets-file", "secrets.json", "file the encrypted secrets are stored in")
+	masterKeyFile         = flag.String("master-key-file", "", "file holding the base64 master key (default $HIGHWAY_MASTER_KEY)")
+	previousMasterKeyFile = flag.String("previous-master-key-file", "", "file holding the previous base64 master key, used to re-encrypt secrets after rotation (default $HIGHWAY_PREVIOUS_MASTER_KEY)")
+)
+
+var (
+	secretsAEAD      cipher.AEAD
+	encryptedSecrets = make(map[string]encryptedSecret)
+	secretValues     = make(map[string]string)
+	redactor         = strings.NewReplacer()
+	secretsMu        sync.Mutex
+)
+
+var (
+	secretNamePattern      = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+	secretReferencePattern = regexp.MustCompile(`\$\{secret:([A-Za-z0-9_.-]+)\}`)
+)
+
+var (
+	errSecretsDisabled = errors.New("Secrets are disabled, no master key configured")
+	errSecretNotFound  = errors.New("Secret not found")
+)
+
+// Values shorter than this are not redacted, as they would mangle
+// unrelated output.
+const minRedactedLength = 4
+
+func readMasterKey(file, env string) ([]byte, error) {
+	encoded := os.Getenv(env)
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(data)
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("decoding master key: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, errors.New("master key must be 32 bytes")
+	}
+	return key, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// loadSecrets reads the master key and decrypts the secrets file. Secrets
+// that only decrypt with the previous master key are re-encrypted with the
+// current one.
+func loadSecrets() error {
+	key, err := readMasterKey(*masterKeyFile, "HIGHWAY_MASTER_KEY")
+	if err != nil || key == nil {
+		return err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	var previous cipher.AEAD
+	previousKey, err := readMasterKey(*previousMasterKeyFile, "HIGHWAY_PREVIOUS_MASTER_KEY")
+	if err != nil {
+		return err
+	}
+	if previousKey != nil {
+		if previous, err = newAEAD(previousKey); err != nil {
+			return err
+		}
+	}
+
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	secretsAEAD = aead
+
+	data, err := os.ReadFile(*secretsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &encryptedSecrets); err != nil {
+		return fmt.Errorf("parsing %s: %v", *secretsFile, err)
+	}
+
+	rotated := false
+	for name, e := range encryptedSecrets {
+		plaintext, err := aead.Open(nil, e.Nonce, e.Ciphertext, []byte(name))
+		if err != nil && previous != nil {
+			plaintext, err = previous.Open(nil, e.Nonce, e.Ciphertext, []byte(name))
+			if err == nil {
+				encryptedSecrets[name] = sealSecret(name, string(plaintext), e.Version, e.UpdatedAt)
+				rotated = true
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("decrypting secret %s: %v", name, err)
+		}
+		secretValues[name] = string(plaintext)
+	}
+	updateRedactor()
+
+	if rotated {
+		fmt.Println("Secrets re-encrypted with the current master key")
+		return saveSecrets()
+	}
+	return nil
+}
+
+// sealSecret encrypts a value, binding it to its name. The caller must hold
+// secretsMu.
+func sealSecret(name, value string, version int, updatedAt time.Time) encryptedSecret {
+	nonce := make([]byte, secretsAEAD.NonceSize())
+	rand.Read(nonce)
+	return encryptedSecret{
+		Version:    version,
+		Nonce:      nonce,
+		Ciphertext: secretsAEAD.Seal(nil, nonce, []byte(value), []byte(name)),
+		UpdatedAt:  updatedAt,
+	}
+}
+
+// saveSecrets atomically rewrites the secrets file. The caller must hold
+// secretsMu.
+func saveSecrets() error {
+	data, err := json.MarshalIndent(encryptedSecrets, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := *secretsFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, *secretsFile)
+}
+
+// updateRedactor rebuilds the replacer hiding secret values, longest first
+// so a secret containing another is redacted whole. The caller must hold
+// secretsMu.
+func updateRedactor() {
+	values := make([]string, 0, len(secretValues))
+	for _, v := range secretValues {
+		if len(v) >= minRedactedLength {
+			values = append(values, v)
+		}
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+
+	pairs := make([]string, 0, 2*len(values))
+	for _, v := range values {
+		pairs = append(pairs, v, "[REDACTED]")
+	}
+	redactor = strings.NewReplacer(pairs...)
+}
+
+// redact hides every known secret value in s.
+func redact(s string) string {
+	secretsMu.Lock()
+	r := redactor
+	secretsMu.Unlock()
+	return r.Replace(s)
+}
+
+// redactJSON hides every known secret value in the strings of a JSON
+// document. Redacting the encoded document instead would miss values that
+// JSON escapes.
+func redactJSON(data json.RawMessage) json.RawMessage {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return json.RawMessage(redact(string(data)))
+	}
+	redacted, err := json.Marshal(redactValue(v))
+	if err != nil {
+		return json.RawMessage(redact(string(data)))
+	}
+	return redacted
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return redact(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			redacted[redact(key)] = redactValue(value)
+		}
+		return redacted
+	}
+	return v
+}
+
+// resolveSecrets replaces ${secret:name} references with secret values.
+func resolveSecrets(s string) (string, error) {
+	if !strings.Contains(s, "${secret:") {
+		return s, nil
+	}
+
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	var err error
+	resolved := secretReferencePattern.ReplaceAllStringFunc(s, func(ref string) string {
+		name := secretReferencePattern.FindStringSubmatch(ref)[1]
+		v, ok := secretValues[name]
+		if !ok && err == nil {
+			err = fmt.Errorf("unknown secret %q", name)
+		}
+		return v
+	})
+	return resolved, err
+}
+
+func setSecret(name, value string) (SecretInfo, error) {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	if secretsAEAD == nil {
+		return SecretInfo{}, errSecretsDisabled
+	}
+
+	previous, existed := encryptedSecrets[name]
+	e := sealSecret(name, value, encryptedSecrets[name].Version+1, clock.Now())
+	encryptedSecrets[name] = e
+	if err := saveSecrets(); err != nil {
+		if existed {
+			encryptedSecrets[name] = previous
+		} else {
+			delete(encryptedSecrets, name)
+		}
+		return SecretInfo{}, err
+	}
+
+	secretValues[name] = value
+	updateRedactor()
+	return SecretInfo{Name: name, Version: e.Version, UpdatedAt: e.UpdatedAt}, nil
+}
+
+func deleteSecret(name string) error {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	if secretsAEAD == nil {
+		return errSecretsDisabled
+	}
+	e, ok := encryptedSecrets[name]
+	if !ok {
+		return errSecretNotFound
+	}
+
+	delete(encryptedSecrets, name)
+	if err := saveSecrets(); err != nil {
+		encryptedSecrets[name] = e
+		return err
+	}
+	delete(secretValues, name)
+	updateRedactor()
+	return nil
+}
+
+func secretsHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Path[len("/secrets/"):]
+
+	switch r.Method {
+	case "GET":
+		secretsMu.Lock()
+		list := make([]SecretInfo, 0, len(encryptedSecrets))
+		for n, e := range encryptedSecrets {
+			list = append(list, SecretInfo{Name: n, Version: e.Version, UpdatedAt: e.UpdatedAt})
+		}
+		secretsMu.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case "PUT":
+		var request struct {
+			Value string `json:"value"`
+		}
+
+		if !secretNamePattern.MatchString(name) {
+			http.Error(w, "Invalid secret name", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Error reading request body", http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.Unmarshal(body, &request); err != nil {
+			http.Error(w, "Error parsing request body", http.StatusBadRequest)
+			return
+		}
+
+		info, err := setSecret(name, request.Value)
+		if err == errSecretsDisabled {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Error storing secret", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	case "DELETE":
+		switch err := deleteSecret(name); err {
+		case nil:
+			w.WriteHeader(http.StatusOK)
+		case errSecretsDisabled:
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		case errSecretNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(w, "Error deleting secret", http.StatusInternalServerError)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A semaphore hands out up to capacity permits to leases. Waiters are
+// served strictly in arrival order: a waiter asking for many permits holds
+// back later waiters until enough permits are free for it.
+type semaphore struct {
+	name     string
+	capacity int
+	used     int
+	holders  map[string]*semaphoreHolder
+	waiters  []*semaphoreWaiter
+}
+
+type semaphoreHolder struct {
+	lease   *lease
+	permits int
+}
+
+type semaphoreWaiter struct {
+	holder  string
+	permits int
+	ttl     time.Duration
+	granted chan SemaphoreGrant
+}
+
+type SemaphoreGrant struct {
+	Name    string    `json:"name"`
+	LeaseID string    `json:"leaseId"`
+	Holder  string    `json:"holder,omitempty"`
+	Permits int       `json:"permits"`
+	Expires time.Time `json:"expires"`
+}
+
+type SemaphoreState struct {
+	Name      string         `json:"name"`
+	Capacity  int            `json:"capacity"`
+	Available int            `json:"available"`
+	Holders   []SemaphoreUse `json:"holders"`
+	Waiters   []SemaphoreUse `json:"waiters"`
+}
+
+// SemaphoreUse is a holder or waiter as shown to other clients.
+type SemaphoreUse struct {
+	Holder  string     `json:"holder,omitempty"`
+	Permits int        `json:"permits"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+var (
+	semaphores   = make(map[string]*semaphore)
+	semaphoresMu sync.Mutex
+)
+
+// state describes the semaphore without revealing lease IDs. The caller
+// must hold semaphoresMu.
+func (s *semaphore) state() SemaphoreState {
+	st := SemaphoreState{
+		Name:      s.name,
+		Capacity:  s.capacity,
+		Available: s.capacity - s.used,
+		Holders:   make([]SemaphoreUse, 0, len(s.holders)),
+		Waiters:   make([]SemaphoreUse, 0, len(s.waiters)),
+	}
+	if st.Available < 0 {
+		st.Available = 0
+	}
+	for _, h := range s.holders {
+		expires := h.lease.Expires
+		st.Holders = append(st.Holders, SemaphoreUse{Holder: h.lease.Holder, Permits: h.permits, Expires: &expires})
+	}
+	sort.Slice(st.Holders, func(i, j int) bool { return st.Holders[i].Expires.Before(*st.Holders[j].Expires) })
+	for _, w := range s.waiters {
+		st.Waiters = append(st.Waiters, SemaphoreUse{Holder: w.holder, Permits: w.permits})
+	}
+	return st
+}
+
+// grant takes permits for a new lease. The caller must hold semaphoresMu.
+func (s *semaphore) grant(holder string, permits int, ttl time.Duration) SemaphoreGrant {
+	l := newLease(holder, ttl)
+	s.holders[l.ID] = &semaphoreHolder{lease: l, permits: permits}
+	s.used += permits
+	l.watch(&semaphoresMu, func() {
+		fmt.Printf("Semaphore lease expired: %s: %d permits\n", s.name, permits)
+		s.release(l.ID)
+	})
+	return SemaphoreGrant{Name: s.name, LeaseID: l.ID, Holder: holder, Permits: permits, Expires: l.Expires}
+}
+
+// release returns the permits of a lease and wakes the waiters they
+// satisfy. The caller must hold semaphoresMu.
+func (s *semaphore) release(leaseID string) bool {
+	h, ok := s.holders[leaseID]
+	if !ok {
+		return false
+	}
+	h.lease.end()
+	delete(s.holders, leaseID)
+	s.used -= h.permits
+	s.wake()
+	return true
+}
+
+// wake grants permits to waiters from the front of the queue for as long
+// as they fit. The caller must hold semaphoresMu.
+func (s *semaphore) wake() {
+	for len(s.waiters) > 0 && s.waiters[0].permits <= s.capacity-s.used {
+		w := s.waiters[0]
+		s.waiters = s.waiters[1:]
+		w.granted <- s.grant(w.holder, w.permits, w.ttl)
+	}
+}
+
+func (s *semaphore) removeWaiter(w *semaphoreWaiter) bool {
+	for i, other := range s.waiters {
+		if other == w {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			// Waiters queued behind this one may fit now.
+			s.wake()
+			return true
+		}
+	}
+	return false
+}
+
+func semaphoreHandler(w http.ResponseWriter, r *http.Request) {
+	name, action := splitAction(r.URL.Path, "/semaphores/", "acquire", "renew", "release")
+	if name == "" && r.Method == "GET" {
+		handleListSemaphores(w, r)
+		return
+	}
+	if name == "" {
+		http.Error(w, "Missing semaphore name", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == "GET":
+		handleGetSemaphore(w, name)
+	case action == "" && r.Method == "PUT":
+		handlePutSemaphore(w, r, name)
+	case action == "" && r.Method == "DELETE":
+		handleDeleteSemaphore(w, name)
+	case action == "acquire" && r.Method == "POST":
+		handleAcquireSemaphore(w, r, name)
+	case action == "renew" && r.Method == "POST":
+		handleRenewSemaphore(w, r, name)
+	case action == "release" && r.Method == "POST":
+		handleReleaseSemaphore(w, r, name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleListSemaphores(w http.ResponseWriter, r *http.Request) {
+	tenant := requestTenant(r)
+	semaphoresMu.Lock()
+	defer semaphoresMu.Unlock()
+
+	list := make([]SemaphoreState, 0, len(semaphores))
+	for name, s := range semaphores {
+		if inTenant(tenant, name) {
+			list = append(list, s.state())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJSON(w, http.StatusOK, list)
+}
+
+func handleGetSemaphore(w http.ResponseWriter, name string) {
+	semaphoresMu.Lock()
+	defer semaphoresMu.Unlock()
+
+	s, ok := semaphores[name]
+	if !ok {
+		http.Error(w, "Semaphore not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.state())
+}
+
+// handlePutSemaphore creates a semaphore or changes its capacity. Lowering
+// the capacity below the permits in use does not revoke any leases.
+func handlePutSemaphore(w http.ResponseWriter, r *http.Request, name string) {
+	var request struct {
+		Capacity int `json:"capacity"`
+	}
+	if !readJSONBody(w, r, &request) {
+		return
+	}
+	if request.Capacity <= 0 {
+		http.Error(w, "Capacity must be positive", http.StatusBadRequest)
+		return
+	}
+
+	semaphoresMu.Lock()
+	defer semaphoresMu.Unlock()
+
+	s, ok := semaphores[name]
+	if !ok {
+		s = &semaphore{name: name, holders: make(map[string]*semaphoreHolder)}
+		semaphores[name] = s
+	}
+	s.capacity = request.Capacity
+	s.wake()
+	writeJSON(w, http.StatusOK, s.state())
+}
+
+func handleDeleteSemaphore(w http.ResponseWriter, name string) {
+	semaphoresMu.Lock()
+	defer semaphoresMu.Unlock()
+
+	s, ok := semaphores[name]
+	if !ok {
+		http.Error(w, "Semaphore not found", http.StatusNotFound)
+		return
+	}
+	if len(s.holders) > 0 || len(s.waiters) > 0 {
+		http.Error(w, "Semaphore in use", http.StatusConflict)
+		return
+	}
+	delete(semaphores, name)
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleAcquireSemaphore takes permits if they are free and nobody is
+// queued ahead. Otherwise it fails at once, or waits up to waitSeconds.
+func handleAcquireSemaphore(w http.ResponseWriter, r *http.Request, name string) {
+	var request struct {
+		Holder      string `json:"holder"`
+		Permits     int    `json:"permits"`
+		TTLSeconds  int    `json:"ttlSeconds"`
+		WaitSeconds int    `json:"waitSeconds"`
+	}
+	if !readJSONBody(w, r, &request) {
+		return
+	}
+	if request.Permits <= 0 {
+		request.Permits = 1
+	}
+	ttl := seconds(request.TTLSeconds, defaultLeaseTTL)
+
+	semaphoresMu.Lock()
+	s, ok := semaphores[name]
+	if !ok {
+		semaphoresMu.Unlock()
+		http.Error(w, "Semaphore not found", http.StatusNotFound)
+		return
+	}
+	if request.Permits > s.capacity {
+		semaphoresMu.Unlock()
+		http.Error(w, "Permits exceed capacity", http.StatusBadRequest)
+		return
+	}
+	if len(s.waiters) == 0 && request.Permits <= s.capacity-s.used {
+		g := s.grant(request.Holder, request.Permits, ttl)
+		semaphoresMu.Unlock()
+		writeJSON(w, http.StatusOK, g)
+		return
+	}
+	if request.WaitSeconds <= 0 {
+		st := s.state()
+		semaphoresMu.Unlock()
+		writeJSON(w, http.StatusConflict, st)
+		return
+	}
+
+	waiter := &semaphoreWaiter{
+		holder:  request.Holder,
+		permits: request.Permits,
+		ttl:     ttl,
+		granted: make(chan SemaphoreGrant, 1),
+	}
+	s.waiters = append(s.waiters, waiter)
+	semaphoresMu.Unlock()
+
+	timer := clock.NewTimer(time.Duration(request.WaitSeconds) * time.Second)
+	defer timer.Stop()
+
+	select {
+	case g := <-waiter.granted:
+		writeJSON(w, http.StatusOK, g)
+		return
+	case <-timer.C():
+	case <-r.Context().Done():
+	}
+
+	semaphoresMu.Lock()
+	defer semaphoresMu.Unlock()
+
+	if s.removeWaiter(waiter) {
+		writeJSON(w, http.StatusConflict, s.state())
+		return
+	}
+
+	// The permits were granted while we gave up waiting.
+	g := <-waiter.granted
+	if r.Context().Err() != nil {
+		s.release(g.LeaseID)
+		return
+	}
+	writeJSON(w, http.StatusOK, g)
+}
+
+func handleRenewSemaphore(w http.ResponseWriter, r *http.Request, name string) {
+	var request struct {
+		LeaseID    string `json:"leaseId"`
+		TTLSeconds int    `json:"ttlSeconds"`
+	}
+	if !readJSONBody(w, r, &request) {
+		return
+	}
+
+	semaphoresMu.Lock()
+	defer semaphoresMu.Unlock()
+
+	s, ok := semaphores[name]
+	if !ok {
+		http.Error(w, "Semaphore not found", http.StatusNotFound)
+		return
+	}
+	h, ok := s.holders[request.LeaseID]
+	if !ok {
+		http.Error(w, "Lease not held", http.StatusConflict)
+		return
+	}
+
+	h.lease.renew(seconds(request.TTLSeconds, defaultLeaseTTL))
+	writeJSON(w, http.StatusOK, SemaphoreGrant{
+		Name:    name,
+		LeaseID: h.lease.ID,
+		Holder:  h.lease.Holder,
+		Permits: h.permits,
+		Expires: h.lease.Expires,
+	})
+}
+
+func handleReleaseSemaphore(w http.ResponseWriter, r *http.Request, name string) {
+	var request struct {
+		LeaseID string `json:"leaseId"`
+	}
+	if !readJSONBody(w, r, &request) {
+		return
+	}
+
+	semaphoresMu.Lock()
+	defer semaphoresMu.Unlock()
+
+	s, ok := semaphores[name]
+	if !ok {
+		http.Error(w, "Semaphore not found", http.StatusNotFound)
+		return
+	}
+	if !s.release(request.LeaseID) {
+		http.Error(w, "Lease not held", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TargetConfig describes how the mock target server responds. Routes are
+// matched by longest path prefix, falling back to the default route.
+type TargetConfig struct {
+	Default TargetRoute            `json:"default"`
+	Routes  map[string]TargetRoute `json:"routes"`
+	// TokenTTLSeconds is the lifetime of tokens issued by /_target/token,
+	// which stands in for an OAuth2 client credentials endpoint.
+	TokenTTLSeconds int `json:"tokenTtlSeconds"`
+}
+
+type TargetRoute struct {
+	Latency Latency `json:"latency"`
+	// Statuses is a weighted mix of status codes; empty means 200.
+	Statuses []WeightedStatus `json:"statuses"`
+	// ErrorRate is the fraction of requests whose connection is dropped
+	// without a response.
+	ErrorRate float64 `json:"errorRate"`
+	// TimeoutRate is the fraction of requests that never get a response.
+	TimeoutRate float64 `json:"timeoutRate"`
+	PayloadSize int     `json:"payloadSize"`
+	// RequireToken rejects requests without a bearer token issued by
+	// /_target/token.
+	RequireToken bool `json:"requireToken"`
+	// Script, when set, is a sequence of responses served in order,
+	// repeating from the start once exhausted.
+	Script []ScriptStep `json:"script"`
+}
+
+// Latency is a response delay distribution: "fixed" uses MeanMs,
+// "uniform" picks between MinMs and MaxMs, "normal" uses MeanMs and
+// StddevMs and "exponential" uses MeanMs.
+type Latency struct {
+	Distribution string  `json:"distribution"`
+	MinMs        float64 `json:"minMs"`
+	MaxMs        float64 `json:"maxMs"`
+	MeanMs       float64 `json:"meanMs"`
+	StddevMs     float64 `json:"stddevMs"`
+}
+
+type WeightedStatus struct {
+	Code   int     `json:"code"`
+	Weight float64 `json:"weight"`
+}
+
+type ScriptStep struct {
+	Status    int    `json:"status"`
+	Body      string `json:"body"`
+	LatencyMs int    `json:"latencyMs"`
+	// Error drops the connection, Timeout never responds.
+	Error   bool `json:"error"`
+	Timeout bool `json:"timeout"`
+}
+
+type targetServer struct {
+	mu       sync.Mutex
+	config   TargetConfig
+	rand     *rand.Rand
+	position map[string]int
+	counts   map[string]map[string]int
+	tokens   map[string]time.Time
+}
+
+func runTarget(args []string) {
+	fs := flag.NewFlagSet("target", flag.ExitOnError)
+	addr := fs.String("addr", ":3000", "address the target server listens on")
+	configFile := fs.String("config", "", "JSON file describing target responses")
+	fs.Parse(args)
+
+	t := &targetServer{
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		position: make(map[string]int),
+		counts:   make(map[string]map[string]int),
+		tokens:   make(map[string]time.Time),
+	}
+
+	if *configFile != "" {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &t.config); err != nil {
+			log.Fatalf("Error parsing target config: %v", err)
+		}
+		if err := t.config.validate(); err != nil {
+			log.Fatalf("Invalid target config: %v", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_target/config", t.configHandler)
+	mux.HandleFunc("/_target/stats", t.statsHandler)
+	mux.HandleFunc("/_target/token", t.tokenHandler)
+	mux.HandleFunc("/", t.serve)
+
+	fmt.Printf("Target server is running on %s\n", *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
+
+func (c TargetConfig) validate() error {
+	if c.TokenTTLSeconds < 0 {
+		return fmt.Errorf("tokenTtlSeconds must not be negative")
+	}
+	if err := c.Default.validate(); err != nil {
+		return fmt.Errorf("default route: %v", err)
+	}
+	for prefix, route := range c.Routes {
+		if err := route.validate(); err != nil {
+			return fmt.Errorf("route %s: %v", prefix, err)
+		}
+	}
+	return nil
+}
+
+func (r TargetRoute) validate() error {
+	switch {
+	case r.PayloadSize < 0:
+		return fmt.Errorf("payloadSize must not be negative")
+	case r.ErrorRate < 0 || r.ErrorRate > 1 || r.TimeoutRate < 0 || r.TimeoutRate > 1:
+		return fmt.Errorf("errorRate and timeoutRate must be between 0 and 1")
+	case r.ErrorRate+r.TimeoutRate > 1:
+		return fmt.Errorf("errorRate and timeoutRate must not add up to more than 1")
+	}
+	if err := r.Latency.validate(); err != nil {
+		return err
+	}
+	for _, s := range r.Statuses {
+		if !validStatus(s.Code) || s.Weight < 0 {
+			return fmt.Errorf("invalid status %d with weight %g", s.Code, s.Weight)
+		}
+	}
+	for i, step := range r.Script {
+		if (step.Status != 0 && !validStatus(step.Status)) || step.LatencyMs < 0 {
+			return fmt.Errorf("invalid script step %d", i)
+		}
+	}
+	return nil
+}
+
+func (l Latency) validate() error {
+	switch l.Distribution {
+	case "", "fixed", "uniform", "normal", "exponential":
+	default:
+		return fmt.Errorf("unknown latency distribution %q", l.Distribution)
+	}
+	if l.MinMs < 0 || l.MaxMs < 0 || l.MeanMs < 0 || l.StddevMs < 0 {
+		return fmt.Errorf("latency must not be negative")
+	}
+	if l.Distribution == "uniform" && l.MinMs > l.MaxMs {
+		return fmt.Errorf("latency minMs must not exceed maxMs")
+	}
+	return nil
+}
+
+func validStatus(code int) bool {
+	return code >= 100 && code <= 599
+}
+
+func (t *targetServer) route(path string) (string, TargetRoute) {
+	prefixes := make([]string, 0, len(t.config.Routes))
+	for prefix := range t.config.Routes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return len(prefixes[i]) > len(prefixes[j]) })
+
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return prefix, t.config.Routes[prefix]
+		}
+	}
+	return "", t.config.Default
+}
+
+func (l Latency) sample(rnd *rand.Rand) time.Duration {
+	var ms float64
+	switch l.Distribution {
+	case "uniform":
+		ms = l.MinMs + rnd.Float64()*(l.MaxMs-l.MinMs)
+	case "normal":
+		ms = l.MeanMs + rnd.NormFloat64()*l.StddevMs
+	case "exponential":
+		ms = rnd.ExpFloat64() * l.MeanMs
+	default:
+		ms = l.MeanMs
+	}
+	return time.Duration(math.Max(ms, 0) * float64(time.Millisecond))
+}
+
+func (r TargetRoute) status(rnd *rand.Rand) int {
+	var total float64
+	for _, s := range r.Statuses {
+		total += s.Weight
+	}
+	pick := rnd.Float64() * total
+	for _, s := range r.Statuses {
+		if pick < s.Weight {
+			return s.Code
+		}
+		pick -= s.Weight
+	}
+	return http.StatusOK
+}
+
+// next decides the response for a request and records it in the counters.
+func (t *targetServer) next(r *http.Request) ScriptStep {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	path := r.URL.Path
+	prefix, route := t.route(path)
+
+	var step ScriptStep
+	if route.RequireToken && !t.validToken(r) {
+		step.Status = http.StatusUnauthorized
+	} else if len(route.Script) > 0 {
+		step = route.Script[t.position[prefix]%len(route.Script)]
+		t.position[prefix]++
+	} else {
+		step.LatencyMs = int(route.Latency.sample(t.rand) / time.Millisecond)
+		pick := t.rand.Float64()
+		switch {
+		case pick < route.ErrorRate:
+			step.Error = true
+		case pick < route.ErrorRate+route.TimeoutRate:
+			step.Timeout = true
+		default:
+			step.Status = route.status(t.rand)
+			step.Body = strings.Repeat("x", route.PayloadSize)
+		}
+	}
+	if step.Status == 0 {
+		step.Status = http.StatusOK
+	}
+
+	outcome := fmt.Sprint(step.Status)
+	if step.Error {
+		outcome = "error"
+	} else if step.Timeout {
+		outcome = "timeout"
+	}
+	if t.counts[path] == nil {
+		t.counts[path] = make(map[string]int)
+	}
+	t.counts[path][outcome]++
+
+	return step
+}
+
+func (t *targetServer) serve(w http.ResponseWriter, r *http.Request) {
+	step := t.next(r)
+
+	select {
+	case <-time.After(time.Duration(step.LatencyMs) * time.Millisecond):
+	case <-r.Context().Done():
+		return
+	}
+
+	if step.Timeout {
+		<-r.Context().Done()
+		return
+	}
+
+	if step.Error {
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "Injected error", http.StatusInternalServerError)
+			return
+		}
+		conn, _, err := hj.Hijack()
+		if err == nil {
+			conn.Close()
+		}
+		return
+	}
+
+	w.WriteHeader(step.Status)
+	io.WriteString(w, step.Body)
+}
+
+func (t *targetServer) validToken(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	expires, ok := t.tokens[token]
+	return ok && time.Now().Before(expires)
+}
+
+// tokenHandler issues a token to any client using the client credentials
+// grant.
+func (t *targetServer) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.FormValue("grant_type") != "client_credentials" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+	if _, _, ok := r.BasicAuth(); !ok && r.FormValue("client_id") == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	t.mu.Lock()
+	ttl := t.config.TokenTTLSeconds
+	if ttl <= 0 {
+		ttl = 3600
+	}
+	token := fmt.Sprintf("%016x", t.rand.Uint64())
+	t.tokens[token] = time.Now().Add(time.Duration(ttl) * time.Second)
+	if t.counts[r.URL.Path] == nil {
+		t.counts[r.URL.Path] = make(map[string]int)
+	}
+	t.counts[r.URL.Path]["issued"]++
+	t.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   ttl,
+	})
+}
+
+func (t *targetServer) configHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t.config)
+	case "PUT":
+		var config TargetConfig
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Error reading request body", http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.Unmarshal(body, &config); err != nil {
+			http.Error(w, "Error parsing request body", http.StatusBadRequest)
+			return
+		}
+		if err := config.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		t.mu.Lock()
+		t.config = config
+		t.position = make(map[string]int)
+		t.mu.Unlock()
+
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (t *targetServer) statsHandler(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t.counts)
+	case "DELETE":
+		t.counts = make(map[string]map[string]int)
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
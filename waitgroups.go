@@ -0,0 +1,390 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Wait groups and barriers let remote clients synchronize through the
+// server. A wait group counts outstanding work like sync.WaitGroup and also
+// serves as a countdown latch: add the count once, then count it down with
+// done. A barrier releases its parties together once all of them arrived,
+// and can then be reused by the next round.
+
+var idleTimeout = flag.Duration("coordination-idle-timeout", 10*time.Minute, "how long an unused wait group or barrier is kept")
+
+type waitGroup struct {
+	name     string
+	count    int
+	waiters  int
+	zero     chan struct{}
+	lastUsed time.Time
+}
+
+type WaitGroupState struct {
+	Name     string    `json:"name"`
+	Count    int       `json:"count"`
+	Waiters  int       `json:"waiters"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+type barrier struct {
+	name       string
+	parties    int
+	arrived    int
+	generation int
+	release    chan struct{}
+	lastUsed   time.Time
+}
+
+type BarrierState struct {
+	Name       string    `json:"name"`
+	Parties    int       `json:"parties"`
+	Arrived    int       `json:"arrived"`
+	Generation int       `json:"generation"`
+	LastUsed   time.Time `json:"lastUsed"`
+}
+
+var (
+	waitGroups = make(map[string]*waitGroup)
+	barriers   = make(map[string]*barrier)
+	// waitGroupsMu guards both waitGroups and barriers.
+	waitGroupsMu sync.Mutex
+)
+
+// getWaitGroup returns the named wait group, creating it with a count of
+// zero. The caller must hold waitGroupsMu.
+func getWaitGroup(name string) *waitGroup {
+	g, ok := waitGroups[name]
+	if !ok {
+		g = &waitGroup{name: name, zero: make(chan struct{})}
+		close(g.zero)
+		waitGroups[name] = g
+	}
+	g.lastUsed = clock.Now()
+	return g
+}
+
+func (g *waitGroup) state() WaitGroupState {
+	return WaitGroupState{Name: g.name, Count: g.count, Waiters: g.waiters, LastUsed: g.lastUsed}
+}
+
+// add changes the count, waking the waiters when it drops to zero. The
+// caller must hold waitGroupsMu.
+func (g *waitGroup) add(delta int) bool {
+	if g.count+delta < 0 {
+		return false
+	}
+	if g.count == 0 && delta > 0 {
+		g.zero = make(chan struct{})
+	}
+	g.count += delta
+	if g.count == 0 && delta < 0 {
+		close(g.zero)
+	}
+	return true
+}
+
+func (b *barrier) state() BarrierState {
+	return BarrierState{Name: b.name, Parties: b.parties, Arrived: b.arrived, Generation: b.generation, LastUsed: b.lastUsed}
+}
+
+// collectIdleCoordination periodically removes idle coordination state.
+func collectIdleCoordination() {
+	for {
+		clock.Sleep(*idleTimeout / 10)
+		removeIdleCoordination()
+	}
+}
+
+// removeIdleCoordination forgets wait groups and barriers nobody has used
+// for the idle timeout. Wait groups with outstanding work and barriers with
+// arrived parties are kept, as forgetting them would lose their state.
+func removeIdleCoordination() {
+	waitGroupsMu.Lock()
+	defer waitGroupsMu.Unlock()
+
+	cutoff := clock.Now().Add(-*idleTimeout)
+	for name, g := range waitGroups {
+		if g.count == 0 && g.waiters == 0 && g.lastUsed.Before(cutoff) {
+			delete(waitGroups, name)
+		}
+	}
+	for name, b := range barriers {
+		if b.arrived == 0 && b.lastUsed.Before(cutoff) {
+			delete(barriers, name)
+		}
+	}
+}
+
+// waitTimeout parses the optional timeout query parameter. Zero means
+// waiting until the client disconnects.
+func waitTimeout(r *http.Request) (time.Duration, bool) {
+	v := r.URL.Query().Get("timeout")
+	if v == "" {
+		return 0, true
+	}
+	timeout, err := time.ParseDuration(v)
+	return timeout, err == nil && timeout >= 0
+}
+
+// waitFor waits until ch is closed, the timeout passes or the client goes
+// away, and reports whether ch was closed.
+func waitFor(r *http.Request, ch chan struct{}, timeout time.Duration) bool {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := clock.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C()
+	}
+
+	select {
+	case <-ch:
+		return true
+	case <-expired:
+	case <-r.Context().Done():
+	}
+	return false
+}
+
+func waitGroupHandler(w http.ResponseWriter, r *http.Request) {
+	name, action := splitAction(r.URL.Path, "/waitgroups/", "add", "done", "wait")
+	if name == "" && r.Method == "GET" {
+		handleListWaitGroups(w, r)
+		return
+	}
+	if name == "" {
+		http.Error(w, "Missing wait group name", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == "GET":
+		waitGroupsMu.Lock()
+		g, ok := waitGroups[name]
+		var s WaitGroupState
+		if ok {
+			s = g.state()
+		}
+		waitGroupsMu.Unlock()
+		if !ok {
+			http.Error(w, "Wait group not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	case action == "" && r.Method == "DELETE":
+		// Deleting a wait group with waiters would leave them waiting for a
+		// group nobody can reach any more.
+		waitGroupsMu.Lock()
+		g, ok := waitGroups[name]
+		busy := ok && g.waiters > 0
+		if !busy {
+			delete(waitGroups, name)
+		}
+		waitGroupsMu.Unlock()
+		if busy {
+			http.Error(w, "Wait group has waiters", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case action == "add" && r.Method == "POST":
+		var request struct {
+			Delta int `json:"delta"`
+		}
+		if !readJSONBody(w, r, &request) {
+			return
+		}
+		if request.Delta == 0 {
+			request.Delta = 1
+		}
+		handleAddWaitGroup(w, name, request.Delta)
+	case action == "done" && r.Method == "POST":
+		handleAddWaitGroup(w, name, -1)
+	case action == "wait" && r.Method == "GET":
+		handleWaitWaitGroup(w, r, name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleListWaitGroups(w http.ResponseWriter, r *http.Request) {
+	tenant := requestTenant(r)
+	waitGroupsMu.Lock()
+	defer waitGroupsMu.Unlock()
+
+	list := make([]WaitGroupState, 0, len(waitGroups))
+	for name, g := range waitGroups {
+		if inTenant(tenant, name) {
+			list = append(list, g.state())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJSON(w, http.StatusOK, list)
+}
+
+func handleAddWaitGroup(w http.ResponseWriter, name string, delta int) {
+	waitGroupsMu.Lock()
+	defer waitGroupsMu.Unlock()
+
+	g := getWaitGroup(name)
+	if !g.add(delta) {
+		http.Error(w, "Negative wait group count", http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusOK, g.state())
+}
+
+// handleWaitWaitGroup blocks until the count of the wait group is zero.
+func handleWaitWaitGroup(w http.ResponseWriter, r *http.Request, name string) {
+	timeout, ok := waitTimeout(r)
+	if !ok {
+		http.Error(w, "Invalid timeout parameter", http.StatusBadRequest)
+		return
+	}
+
+	waitGroupsMu.Lock()
+	g := getWaitGroup(name)
+	g.waiters++
+	zero := g.zero
+	waitGroupsMu.Unlock()
+
+	done := waitFor(r, zero, timeout)
+
+	waitGroupsMu.Lock()
+	g.waiters--
+	g.lastUsed = clock.Now()
+	s := g.state()
+	waitGroupsMu.Unlock()
+
+	if !done {
+		writeJSON(w, http.StatusConflict, s)
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+func barrierHandler(w http.ResponseWriter, r *http.Request) {
+	name, action := splitAction(r.URL.Path, "/barriers/", "arrive")
+	if name == "" && r.Method == "GET" {
+		handleListBarriers(w, r)
+		return
+	}
+	if name == "" {
+		http.Error(w, "Missing barrier name", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == "GET":
+		waitGroupsMu.Lock()
+		b, ok := barriers[name]
+		var s BarrierState
+		if ok {
+			s = b.state()
+		}
+		waitGroupsMu.Unlock()
+		if !ok {
+			http.Error(w, "Barrier not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	case action == "" && r.Method == "DELETE":
+		waitGroupsMu.Lock()
+		b, ok := barriers[name]
+		busy := ok && b.arrived > 0
+		if !busy {
+			delete(barriers, name)
+		}
+		waitGroupsMu.Unlock()
+		if busy {
+			http.Error(w, "Barrier has arrived parties", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case action == "arrive" && r.Method == "POST":
+		handleArriveBarrier(w, r, name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleListBarriers(w http.ResponseWriter, r *http.Request) {
+	tenant := requestTenant(r)
+	waitGroupsMu.Lock()
+	defer waitGroupsMu.Unlock()
+
+	list := make([]BarrierState, 0, len(barriers))
+	for name, b := range barriers {
+		if inTenant(tenant, name) {
+			list = append(list, b.state())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleArriveBarrier waits until the given number of parties, including
+// the caller, arrived at the barrier. A party that gives up waiting is no
+// longer counted as arrived.
+func handleArriveBarrier(w http.ResponseWriter, r *http.Request, name string) {
+	var request struct {
+		Parties int `json:"parties"`
+	}
+	if !readJSONBody(w, r, &request) {
+		return
+	}
+	if request.Parties <= 0 {
+		http.Error(w, "Parties must be positive", http.StatusBadRequest)
+		return
+	}
+	timeout, ok := waitTimeout(r)
+	if !ok {
+		http.Error(w, "Invalid timeout parameter", http.StatusBadRequest)
+		return
+	}
+
+	waitGroupsMu.Lock()
+	b, ok := barriers[name]
+	if !ok {
+		b = &barrier{name: name, parties: request.Parties, release: make(chan struct{})}
+		barriers[name] = b
+	}
+	if b.parties != request.Parties {
+		s := b.state()
+		waitGroupsMu.Unlock()
+		writeJSON(w, http.StatusConflict, s)
+		return
+	}
+
+	b.lastUsed = clock.Now()
+	b.arrived++
+	if b.arrived == b.parties {
+		close(b.release)
+		b.release = make(chan struct{})
+		b.arrived = 0
+		b.generation++
+		s := b.state()
+		waitGroupsMu.Unlock()
+		writeJSON(w, http.StatusOK, s)
+		return
+	}
+	release := b.release
+	generation := b.generation
+	waitGroupsMu.Unlock()
+
+	done := waitFor(r, release, timeout)
+
+	waitGroupsMu.Lock()
+	defer waitGroupsMu.Unlock()
+
+	// The barrier may have tripped while we gave up waiting.
+	if !done && b.generation == generation {
+		b.arrived--
+		writeJSON(w, http.StatusConflict, b.state())
+		return
+	}
+	writeJSON(w, http.StatusOK, b.state())
+}